@@ -16,10 +16,18 @@ var (
 
 	ErrTokenNotFound = fmt.Errorf("Token not found\n")
 	ErrTokenExist    = fmt.Errorf("Token already exists\n")
+	ErrUnauthorized  = fmt.Errorf("Token not authorized for tags\n")
 
 	// the list of available authenticators
 	authenticators = map[string]handleFunc{}
 	authTex        sync.RWMutex
+
+	// the tags granted to each token, so authorizing doesn't go to the
+	// authenticator on every publish; the auth commands forget a token's grants
+	// when they change them
+	grants    = map[string]map[string]struct{}{}
+	grantsGen uint64 // counts up every time grants are forgotten
+	grantsTex sync.RWMutex
 )
 
 type (
@@ -81,5 +89,69 @@ func Start(uri string) error {
 	}
 	isConfigured = true
 
+	grantsTex.Lock()
+	grants = map[string]map[string]struct{}{}
+	grantsTex.Unlock()
+
+	return nil
+}
+
+// Authorize checks to see if every one of tags has been granted to token; tags
+// are granted individually, so any combination of granted tags is authorized
+func Authorize(token string, tags []string) error {
+	granted, err := grantsFor(token)
+	if err != nil {
+		return err
+	}
+
+	// every tag needs to have been granted
+	for _, tag := range tags {
+		if _, ok := granted[tag]; !ok {
+			return ErrUnauthorized
+		}
+	}
+
 	return nil
 }
+
+// grantsFor returns the tags granted to a token, getting them from the
+// authenticator the first time
+func grantsFor(token string) (map[string]struct{}, error) {
+	grantsTex.RLock()
+	granted, ok := grants[token]
+	gen := grantsGen
+	grantsTex.RUnlock()
+	if ok {
+		return granted, nil
+	}
+
+	// get the authorized tags for the token
+	tags, err := defaultAuth.GetTagsForToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	// index the granted tags so each tag can be checked
+	granted = make(map[string]struct{}, len(tags))
+	for _, tag := range tags {
+		granted[tag] = struct{}{}
+	}
+
+	// grants that changed while they were being gotten could already be stale
+	grantsTex.Lock()
+	if gen == grantsGen {
+		grants[token] = granted
+	}
+	grantsTex.Unlock()
+
+	return granted, nil
+}
+
+// forget forgets the tags granted to a token, so they're gotten again from the
+// authenticator the next time they're needed
+func forget(token string) {
+	grantsTex.Lock()
+	delete(grants, token)
+	grantsGen++
+	grantsTex.Unlock()
+}
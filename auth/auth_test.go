@@ -1,13 +1,16 @@
 package auth_test
 
 import (
+	"fmt"
 	"net/url"
 	"os"
 	"testing"
 
+	"github.com/alicebob/miniredis"
 	_ "github.com/lib/pq"
 
 	mistAuth "github.com/nanopack/mist/auth"
+	"github.com/nanopack/mist/core"
 )
 
 var (
@@ -46,6 +49,70 @@ func TestMemory(t *testing.T) {
 	}
 
 	testAuth(mem, t)
+
+	// tokens are looked up (authorizing connections) while they're changed
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			mem.AddToken(fmt.Sprint(i))
+			mem.RemoveToken(fmt.Sprint(i))
+		}
+		close(done)
+	}()
+	for i := 0; i < 1000; i++ {
+		mem.GetTagsForToken(fmt.Sprint(i))
+	}
+	<-done
+}
+
+// counting is a memory authenticator that counts how many times tags are gotten
+type counting struct {
+	mistAuth.Authenticator
+	gets int
+}
+
+// GetTagsForToken counts getting the tags for a token
+func (c *counting) GetTagsForToken(token string) ([]string, error) {
+	c.gets++
+	return c.Authenticator.GetTagsForToken(token)
+}
+
+// TestAuthorize tests that a token's grants are only gotten from the
+// authenticator once, until the auth commands change them
+func TestAuthorize(t *testing.T) {
+	mem, _ := mistAuth.NewMemory(nil)
+	store := &counting{Authenticator: mem}
+	mistAuth.Register("counting", func(url *url.URL) (mistAuth.Authenticator, error) { return store, nil })
+	if err := mistAuth.Start("counting://"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer mistAuth.Start("")
+
+	handlers := mistAuth.GenerateHandlers()
+	handlers["register"](nil, mist.Message{Data: testToken, Tags: []string{testTag1}})
+
+	for i := 0; i < 10; i++ {
+		if err := mistAuth.Authorize(testToken, []string{testTag1}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	if store.gets != 1 {
+		t.Fatalf("Expected tags to be gotten once, got them %d times", store.gets)
+	}
+
+	// changes are seen right away
+	handlers["set"](nil, mist.Message{Data: testToken, Tags: []string{testTag2}})
+	if err := mistAuth.Authorize(testToken, []string{testTag2}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	handlers["unset"](nil, mist.Message{Data: testToken, Tags: []string{testTag1}})
+	if err := mistAuth.Authorize(testToken, []string{testTag1}); err != mistAuth.ErrUnauthorized {
+		t.Fatalf("Expected unset tag to be unauthorized")
+	}
+	handlers["unregister"](nil, mist.Message{Data: testToken})
+	if err := mistAuth.Authorize(testToken, nil); err == nil {
+		t.Fatalf("Expected unregistered token to be unauthorized")
+	}
 }
 
 // TestScribble tests the scribble authenticator
@@ -69,6 +136,56 @@ func TestScribble(t *testing.T) {
 	testAuth(scribble, t)
 }
 
+// TestRedis tests the redis authenticator (against an in-process redis)
+func TestRedis(t *testing.T) {
+
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer server.Close()
+
+	// the password and db index from the uri should be honored
+	server.RequireAuth("secret")
+
+	url, err := url.Parse("redis://:secret@" + server.Addr() + "/2")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	redis, err := mistAuth.NewRedis(url)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// registering the same token twice should fail
+	if err := redis.AddToken(testToken); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := redis.AddToken(testToken); err != mistAuth.ErrTokenExist {
+		t.Fatalf("Expected token to exist!")
+	}
+	if !server.DB(2).Exists("mist:tokens") {
+		t.Fatalf("Token not stored in db 2!")
+	}
+	if err := redis.RemoveToken(testToken); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// tags can't be added to a token that doesn't exist
+	if err := redis.AddTags(testToken, []string{testTag1}); err != mistAuth.ErrTokenNotFound {
+		t.Fatalf("Expected token not to be found!")
+	}
+
+	testAuth(redis, t)
+
+	// a bad password should fail to connect
+	url, _ = url.Parse("redis://:wrong@" + server.Addr())
+	if _, err := mistAuth.NewRedis(url); err == nil {
+		t.Fatalf("Expected bad password to fail!")
+	}
+}
+
 // TestPostgres tests the postgres authenticator (requires running postgres server)
 // func TestPostgres(t *testing.T) {
 //
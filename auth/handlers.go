@@ -15,6 +15,7 @@ func GenerateHandlers() map[string]mist.HandleFunc {
 
 // handleRegister
 func handleRegister(proxy *mist.Proxy, msg mist.Message) error {
+	defer forget(msg.Data)
 
 	if err := defaultAuth.AddToken(msg.Data); err != nil {
 		return err
@@ -29,6 +30,7 @@ func handleRegister(proxy *mist.Proxy, msg mist.Message) error {
 
 // handleUnregister
 func handleUnregister(proxy *mist.Proxy, msg mist.Message) error {
+	defer forget(msg.Data)
 
 	if err := defaultAuth.RemoveToken(msg.Data); err != nil {
 		return err
@@ -39,6 +41,7 @@ func handleUnregister(proxy *mist.Proxy, msg mist.Message) error {
 
 // handleSet
 func handleSet(proxy *mist.Proxy, msg mist.Message) error {
+	defer forget(msg.Data)
 
 	if err := defaultAuth.AddTags(msg.Data, msg.Tags); err != nil {
 		return err
@@ -49,6 +52,7 @@ func handleSet(proxy *mist.Proxy, msg mist.Message) error {
 
 // handleUnset
 func handleUnset(proxy *mist.Proxy, msg mist.Message) error {
+	defer forget(msg.Data)
 
 	if err := defaultAuth.RemoveTags(msg.Data, msg.Tags); err != nil {
 		return err
@@ -2,12 +2,18 @@ package auth
 
 import (
 	"net/url"
+	"sync"
 
 	"github.com/deckarep/golang-set"
 )
 
-// memory is a new in-memory set (map) of token/tag combination
-type memory map[string]mapset.Set
+// memory is a new in-memory set (map) of token/tag combination; it's locked
+// since connections authorize against it while admins change it
+type memory struct {
+	sync.RWMutex
+
+	tokens map[string]mapset.Set
+}
 
 // add "memory" to the list of supported Authenticators
 func init() {
@@ -16,11 +22,13 @@ func init() {
 
 // NewMemory creates a new in-memory Authenticator
 func NewMemory(url *url.URL) (Authenticator, error) {
-	return memory{}, nil
+	return &memory{tokens: map[string]mapset.Set{}}, nil
 }
 
 // AddToken adds Token
-func (a memory) AddToken(token string) error {
+func (a *memory) AddToken(token string) error {
+	a.Lock()
+	defer a.Unlock()
 
 	// look for an existing token
 	if _, err := a.findMemoryToken(token); err == nil {
@@ -28,19 +36,24 @@ func (a memory) AddToken(token string) error {
 	}
 
 	// create a new token
-	a[token] = mapset.NewSet()
+	a.tokens[token] = mapset.NewSet()
 
 	return nil
 }
 
 // RemoveToken
-func (a memory) RemoveToken(token string) error {
-	delete(a, token)
+func (a *memory) RemoveToken(token string) error {
+	a.Lock()
+	defer a.Unlock()
+
+	delete(a.tokens, token)
 	return nil
 }
 
 // AddTags
-func (a memory) AddTags(token string, tags []string) error {
+func (a *memory) AddTags(token string, tags []string) error {
+	a.RLock()
+	defer a.RUnlock()
 
 	// look for an existing token
 	entry, err := a.findMemoryToken(token)
@@ -57,7 +70,9 @@ func (a memory) AddTags(token string, tags []string) error {
 }
 
 // RemoveTags
-func (a memory) RemoveTags(token string, tags []string) error {
+func (a *memory) RemoveTags(token string, tags []string) error {
+	a.RLock()
+	defer a.RUnlock()
 
 	// look for an existing token
 	entry, err := a.findMemoryToken(token)
@@ -74,7 +89,9 @@ func (a memory) RemoveTags(token string, tags []string) error {
 }
 
 // GetTagsForToken
-func (a memory) GetTagsForToken(token string) ([]string, error) {
+func (a *memory) GetTagsForToken(token string) ([]string, error) {
+	a.RLock()
+	defer a.RUnlock()
 
 	// look for an existing token
 	entry, err := a.findMemoryToken(token)
@@ -91,11 +108,12 @@ func (a memory) GetTagsForToken(token string) ([]string, error) {
 	return tags, nil
 }
 
-// findMemoryToken attempts to find the desired token within memory
-func (a memory) findMemoryToken(token string) (mapset.Set, error) {
+// findMemoryToken attempts to find the desired token within memory. This has
+// to be called with the memory locked.
+func (a *memory) findMemoryToken(token string) (mapset.Set, error) {
 
 	// look for existing token
-	entry, ok := a[token]
+	entry, ok := a.tokens[token]
 	if !ok {
 		return nil, ErrTokenNotFound
 	}
@@ -1,11 +1,23 @@
 package auth
 
 import (
+	"fmt"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
 )
 
+// the set of all registered tokens; each token's tags are then stored in their
+// own set (see redisTagsKey)
+const redisTokensKey = "mist:tokens"
+
 // redis is an Authenticator that interfaces with the redis database
-type redis struct{}
+type redis struct {
+	pool *redigo.Pool
+}
 
 // add "redis" to the list of supported Authenticatores
 func init() {
@@ -13,31 +25,180 @@ func init() {
 }
 
 // NewRedis creates a new "redis" Authenticator
+// (redis://[:password@]host[:port][/db] or redis://[:password@]host[:port]?db=)
 func NewRedis(url *url.URL) (Authenticator, error) {
-	return &redis{}, nil
+
+	host := url.Host
+	if host == "" {
+		host = "127.0.0.1:6379"
+	}
+
+	// add the default port if one isn't provided
+	if !strings.Contains(host, ":") {
+		host += ":6379"
+	}
+
+	// get the db index from either the path or the query; the query wins
+	db := strings.TrimPrefix(url.Path, "/")
+	if url.Query().Get("db") != "" {
+		db = url.Query().Get("db")
+	}
+
+	dbIndex := 0
+	if db != "" {
+		var err error
+		if dbIndex, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("Invalid database index '%s'", db)
+		}
+	}
+
+	var password string
+	if url.User != nil {
+		password, _ = url.User.Password()
+	}
+
+	a := &redis{
+		pool: &redigo.Pool{
+			MaxIdle:     3,
+			IdleTimeout: 240 * time.Second,
+			Dial: func() (redigo.Conn, error) {
+				return redigo.Dial("tcp", host, redigo.DialPassword(password), redigo.DialDatabase(dbIndex))
+			},
+		},
+	}
+
+	// ensure the database can actually be reached
+	if _, err := a.do("PING"); err != nil {
+		return nil, fmt.Errorf("Failed to connect to redis - %s", err.Error())
+	}
+
+	return a, nil
 }
 
 // AddToken
 func (a *redis) AddToken(token string) error {
+
+	// SADD only adds the token if it isn't already a member
+	added, err := redigo.Int(a.do("SADD", redisTokensKey, token))
+	if err != nil {
+		return err
+	}
+
+	if added == 0 {
+		return ErrTokenExist
+	}
+
 	return nil
 }
 
 // RemoveToken
 func (a *redis) RemoveToken(token string) error {
-	return nil
+	conn := a.pool.Get()
+	defer conn.Close()
+
+	// remove the token and its tags together
+	conn.Send("MULTI")
+	conn.Send("SREM", redisTokensKey, token)
+	conn.Send("DEL", redisTagsKey(token))
+	_, err := conn.Do("EXEC")
+
+	return err
 }
 
 // AddTags
 func (a *redis) AddTags(token string, tags []string) error {
-	return nil
+
+	// look for an existing token
+	if len(tags) == 0 {
+		return a.findRedisToken(token)
+	}
+
+	return a.changeTags("SADD", token, tags)
 }
 
 // RemoveTags
 func (a *redis) RemoveTags(token string, tags []string) error {
-	return nil
+
+	// look for an existing token
+	if len(tags) == 0 {
+		return a.findRedisToken(token)
+	}
+
+	return a.changeTags("SREM", token, tags)
 }
 
 // GetTagsForToken
 func (a *redis) GetTagsForToken(token string) ([]string, error) {
-	return nil, nil
+
+	// look for an existing token
+	if err := a.findRedisToken(token); err != nil {
+		return nil, err
+	}
+
+	return redigo.Strings(a.do("SMEMBERS", redisTagsKey(token)))
+}
+
+// changeTags adds (SADD) or removes (SREM) tags from a registered token; the
+// tokens are watched while checking for it, so a token removed in between
+// isn't left with tags (the change is tried again if the tokens changed)
+func (a *redis) changeTags(command, token string, tags []string) error {
+	conn := a.pool.Get()
+	defer conn.Close()
+
+	for {
+		if _, err := conn.Do("WATCH", redisTokensKey); err != nil {
+			return err
+		}
+
+		found, err := redigo.Bool(conn.Do("SISMEMBER", redisTokensKey, token))
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		if !found {
+			conn.Do("UNWATCH")
+			return ErrTokenNotFound
+		}
+
+		conn.Send("MULTI")
+		conn.Send(command, redigo.Args{}.Add(redisTagsKey(token)).AddFlat(tags)...)
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			return err
+		}
+
+		// a nil reply means the tokens changed, and nothing was run
+		if reply != nil {
+			return nil
+		}
+	}
+}
+
+// findRedisToken attempts to find the desired token within redis
+func (a *redis) findRedisToken(token string) error {
+
+	// look for existing token
+	found, err := redigo.Bool(a.do("SISMEMBER", redisTokensKey, token))
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return ErrTokenNotFound
+	}
+
+	return nil
+}
+
+// do runs a single command on a connection from the pool
+func (a *redis) do(command string, args ...interface{}) (interface{}, error) {
+	conn := a.pool.Get()
+	defer conn.Close()
+
+	return conn.Do(command, args...)
+}
+
+// redisTagsKey is the key of the set of tags for a token
+func redisTagsKey(token string) string {
+	return "mist:tags:" + token
 }
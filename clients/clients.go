@@ -1,10 +1,15 @@
 package clients
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jcelliott/lumber"
@@ -12,14 +17,27 @@ import (
 	"github.com/nanopack/mist/core"
 )
 
+var (
+	// callTimeout is how long the client waits on mist to reply to a command that
+	// replies with something it needs (like publishAfter's id)
+	callTimeout = 10 * time.Second
+)
+
 type (
 	// TCP represents a TCP connection to the mist server
 	TCP struct {
 		conn     io.ReadWriteCloser // the connection to the mist server
-		encoder  *json.Encoder      //
+		encoder  *json.Encoder      // writes to the connection; only used with encoderTex held (see send)
 		host     string             //
 		messages chan mist.Message  // the channel that mist server 'publishes' updates to
 		token    string             //
+		tls      *tls.Config        // if set, the connection is made over TLS
+
+		requests    map[string]chan mist.Message // the calls (requests, etc.) waiting on a reply, by correlation
+		requestTex  sync.Mutex                   //
+		correlation uint64                       // the last correlation a call was sent with
+
+		encoderTex sync.Mutex // guards the encoder (see send)
 	}
 )
 
@@ -30,6 +48,22 @@ func New(host, authtoken string) (*TCP, error) {
 		host:     host,
 		messages: make(chan mist.Message),
 		token:    authtoken,
+		requests: map[string]chan mist.Message{},
+	}
+
+	return client, client.connect()
+}
+
+// NewTLS attempts to connect to a running mist server (tls listener) at the
+// clients specified host and port over TLS; to connect to a listener requiring
+// client certificates provide them in the config.
+func NewTLS(host, authtoken string, config *tls.Config) (*TCP, error) {
+	client := &TCP{
+		host:     host,
+		messages: make(chan mist.Message),
+		token:    authtoken,
+		tls:      config,
+		requests: map[string]chan mist.Message{},
 	}
 
 	return client, client.connect()
@@ -40,7 +74,13 @@ func New(host, authtoken string) (*TCP, error) {
 func (c *TCP) connect() error {
 
 	// attempt to connect to the server
-	conn, err := net.Dial("tcp", c.host)
+	var conn net.Conn
+	var err error
+	if c.tls != nil {
+		conn, err = tls.Dial("tcp", c.host, c.tls)
+	} else {
+		conn, err = net.Dial("tcp", c.host)
+	}
 	if err != nil {
 		return fmt.Errorf("Failed to dial '%s' - %s", c.host, err.Error())
 	}
@@ -53,7 +93,7 @@ func (c *TCP) connect() error {
 
 	// if the client was created with a token, authentication is needed
 	if c.token != "" {
-		err = c.encoder.Encode(&mist.Message{Command: "auth", Data: c.token})
+		err = c.send(&mist.Message{Command: "auth", Data: c.token})
 		if err != nil {
 			return fmt.Errorf("Failed to send auth - %s", err.Error())
 		}
@@ -88,9 +128,16 @@ func (c *TCP) connect() error {
 					lumber.Error("[mist client] Failed to get message from mist - %s", err.Error())
 				}
 				conn.Close()
+				c.cancelRequests()
 				close(c.messages)
 				return
 			}
+
+			// replies go to whoever is waiting on the request (or publishAfter)
+			if (msg.Command == "reply" || msg.Command == "publishAfter") && c.deliver(msg) {
+				continue
+			}
+
 			c.messages <- msg // read from this using the .Messages() function
 			lumber.Trace("[mist client] Received message - %#v", msg)
 		}
@@ -99,9 +146,18 @@ func (c *TCP) connect() error {
 	return nil
 }
 
+// send writes a message to the connection; json.Encoder isn't safe to use from
+// more than one goroutine, and a client waiting on a call invites doing so
+func (c *TCP) send(msg *mist.Message) error {
+	c.encoderTex.Lock()
+	defer c.encoderTex.Unlock()
+
+	return c.encoder.Encode(msg)
+}
+
 // Ping the server
 func (c *TCP) Ping() error {
-	return c.encoder.Encode(&mist.Message{Command: "ping"})
+	return c.send(&mist.Message{Command: "ping"})
 }
 
 // Subscribe takes the specified tags and tells the server to subscribe to updates
@@ -112,7 +168,81 @@ func (c *TCP) Subscribe(tags []string) error {
 		return fmt.Errorf("Unable to subscribe - missing tags")
 	}
 
-	return c.encoder.Encode(&mist.Message{Command: "subscribe", Tags: tags})
+	return c.send(&mist.Message{Command: "subscribe", Tags: tags})
+}
+
+// SubscribeReplay subscribes to the specified tags like Subscribe, asking the
+// server to first replay the last [replay] messages it has retained for them,
+// and/or those published after the seq [since]
+func (c *TCP) SubscribeReplay(tags []string, replay int, since uint64) error {
+
+	if len(tags) == 0 {
+		return fmt.Errorf("Unable to subscribe - missing tags")
+	}
+
+	return c.send(&mist.Message{Command: "subscribe", Tags: tags, Replay: replay, Since: since})
+}
+
+// SubscribeAck subscribes to the specified tags like Subscribe, but every message
+// received for them has to be acked (see Ack) or the server sends it again
+func (c *TCP) SubscribeAck(tags []string) error {
+
+	if len(tags) == 0 {
+		return fmt.Errorf("Unable to subscribe - missing tags")
+	}
+
+	return c.send(&mist.Message{Command: "subscribe", Tags: tags, Ack: true})
+}
+
+// SubscribeFilter subscribes to tags, but the server only sends the messages
+// whose data passes the filter (e.g. a JSON field equal to a value, or data
+// matching a regular expression)
+func (c *TCP) SubscribeFilter(tags []string, filter mist.Filter) error {
+
+	if len(tags) == 0 {
+		return fmt.Errorf("Unable to subscribe - missing tags")
+	}
+
+	return c.send(&mist.Message{Command: "subscribe", Tags: tags, Filter: &filter})
+}
+
+// SubscribeGroup subscribes to the specified tags as a member of a group; each
+// message for the group's subscriptions is only sent to one of its members
+func (c *TCP) SubscribeGroup(group string, tags []string) error {
+
+	if len(tags) == 0 {
+		return fmt.Errorf("Unable to subscribe - missing tags")
+	}
+
+	return c.send(&mist.Message{Command: "subscribe", Tags: tags, Group: group})
+}
+
+// UnsubscribeGroup unsubscribes from the specified tags subscribed to as a member
+// of a group
+func (c *TCP) UnsubscribeGroup(group string, tags []string) error {
+
+	if len(tags) == 0 {
+		return fmt.Errorf("Unable to unsubscribe - missing tags")
+	}
+
+	return c.send(&mist.Message{Command: "unsubscribe", Tags: tags, Group: group})
+}
+
+// Ack tells the server a message (by its ID) received for an ack subscription
+// was handled, so it isn't sent again
+func (c *TCP) Ack(id string) error {
+
+	if id == "" {
+		return fmt.Errorf("Unable to ack - missing id")
+	}
+
+	return c.send(&mist.Message{Command: "ack", Data: id})
+}
+
+// SetOverflow tells the server what to do with messages for this client once it
+// falls too far behind on them: "drop-newest", "drop-oldest" or "disconnect"
+func (c *TCP) SetOverflow(policy string) error {
+	return c.send(&mist.Message{Command: "overflow", Data: policy})
 }
 
 // Unsubscribe takes the specified tags and tells the server to unsubscribe from
@@ -123,12 +253,13 @@ func (c *TCP) Unsubscribe(tags []string) error {
 		return fmt.Errorf("Unable to unsubscribe - missing tags")
 	}
 
-	return c.encoder.Encode(&mist.Message{Command: "unsubscribe", Tags: tags})
+	return c.send(&mist.Message{Command: "unsubscribe", Tags: tags})
 }
 
 // Publish sends a message to the mist server to be published to all subscribed
-// clients
-func (c *TCP) Publish(tags []string, data string) error {
+// clients; any headers (content-type, trace ids, etc.) are passed along to them
+// untouched, without affecting who gets the message
+func (c *TCP) Publish(tags []string, data string, headers ...map[string]string) error {
 
 	if len(tags) == 0 {
 		return fmt.Errorf("Unable to publish - missing tags")
@@ -138,34 +269,193 @@ func (c *TCP) Publish(tags []string, data string) error {
 		return fmt.Errorf("Unable to publish - missing data")
 	}
 
-	return c.encoder.Encode(&mist.Message{Command: "publish", Tags: tags, Data: data})
+	msg := mist.Message{Command: "publish", Tags: tags, Data: data}
+	for _, h := range headers {
+		for k, v := range h {
+			if msg.Headers == nil {
+				msg.Headers = map[string]string{}
+			}
+			msg.Headers[k] = v
+		}
+	}
+
+	return c.send(&msg)
+}
+
+// PublishJSON sends v, encoded as JSON, to the mist server to be published to
+// all subscribed clients. It's sent as a JSON value rather than a string, so
+// subscribers can decode it with the message's Decode.
+func (c *TCP) PublishJSON(tags []string, v interface{}) error {
+
+	if len(tags) == 0 {
+		return fmt.Errorf("Unable to publish - missing tags")
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("Unable to publish - %s", err.Error())
+	}
+
+	return c.send(&mist.Message{Command: "publish", Tags: tags, Data: string(data), Raw: true})
+}
+
+// PublishBinary sends arbitrary bytes (newlines, NULs, etc.) to the mist server
+// to be published to all subscribed clients; they're received in the message's
+// Binary
+func (c *TCP) PublishBinary(tags []string, data []byte) error {
+
+	if len(tags) == 0 {
+		return fmt.Errorf("Unable to publish - missing tags")
+	}
+
+	if len(data) == 0 {
+		return fmt.Errorf("Unable to publish - missing data")
+	}
+
+	return c.send(&mist.Message{Command: "publish", Tags: tags, Binary: data})
 }
 
 // PublishAfter sends a message to the mist server to be published to all subscribed
-// clients after a specified delay
+// clients after a specified delay. The server waits out the delay, so the message
+// is published even if the client is gone by then.
 func (c *TCP) PublishAfter(tags []string, data string, delay time.Duration) error {
-	go func() {
-		<-time.After(delay)
-		c.Publish(tags, data)
+	_, err := c.PublishAfterID(tags, data, delay)
+	return err
+}
+
+// PublishAfterID is the same as PublishAfter, but returns the id the message can
+// be cancelled with
+func (c *TCP) PublishAfterID(tags []string, data string, delay time.Duration) (string, error) {
+
+	if len(tags) == 0 {
+		return "", fmt.Errorf("Unable to publish - missing tags")
+	}
+
+	if data == "" {
+		return "", fmt.Errorf("Unable to publish - missing data")
+	}
+
+	reply, err := c.call(mist.Message{Command: "publishAfter", Tags: tags, Data: data, Delay: int(delay / time.Millisecond)}, callTimeout)
+	if err != nil {
+		return "", fmt.Errorf("Unable to publish - %s", err.Error())
+	}
+
+	return reply.Data, nil
+}
+
+// Cancel cancels a message sent with PublishAfterID (by the id it returned) that
+// hasn't been published yet
+func (c *TCP) Cancel(id string) error {
+
+	if id == "" {
+		return fmt.Errorf("Unable to cancel - missing id")
+	}
+
+	return c.send(&mist.Message{Command: "cancel", Data: id})
+}
+
+// Request sends data to one client subscribed to the specified tags and waits for
+// its reply; if nobody replies within [timeout] an error is returned
+func (c *TCP) Request(tags []string, data string, timeout time.Duration) (mist.Message, error) {
+
+	if len(tags) == 0 {
+		return mist.Message{}, fmt.Errorf("Unable to request - missing tags")
+	}
+
+	// the server times the request out too, but the connection could be gone
+	reply, err := c.call(mist.Message{Command: "request", Tags: tags, Data: data, Timeout: int(timeout / time.Millisecond)}, timeout+time.Second)
+	if err != nil {
+		return reply, fmt.Errorf("Request failed - %s", err.Error())
+	}
+
+	return reply, nil
+}
+
+// call sends a message with a correlation of its own, and waits (up to wait) for
+// mist to reply with the same correlation; an error in the reply is returned
+func (c *TCP) call(msg mist.Message, wait time.Duration) (mist.Message, error) {
+	msg.Correlation = strconv.FormatUint(atomic.AddUint64(&c.correlation, 1), 10)
+	reply := make(chan mist.Message, 1)
+
+	c.requestTex.Lock()
+	c.requests[msg.Correlation] = reply
+	c.requestTex.Unlock()
+
+	defer func() {
+		c.requestTex.Lock()
+		delete(c.requests, msg.Correlation)
+		c.requestTex.Unlock()
 	}()
-	return nil
+
+	if err := c.send(&msg); err != nil {
+		return mist.Message{}, err
+	}
+
+	select {
+	case msg, ok := <-reply:
+		if !ok {
+			return mist.Message{}, fmt.Errorf("connection closed")
+		}
+		if msg.Error != "" {
+			return msg, errors.New(msg.Error)
+		}
+		return msg, nil
+	case <-time.After(wait):
+		return mist.Message{}, fmt.Errorf("timed out")
+	}
+}
+
+// Reply replies to a request received from the server (with the correlation it
+// was received with)
+func (c *TCP) Reply(correlation, data string) error {
+
+	if correlation == "" {
+		return fmt.Errorf("Unable to reply - missing correlation")
+	}
+
+	return c.send(&mist.Message{Command: "reply", Correlation: correlation, Data: data})
+}
+
+// deliver hands a reply to the call waiting on it, returning whether one was
+func (c *TCP) deliver(msg mist.Message) bool {
+	c.requestTex.Lock()
+	defer c.requestTex.Unlock()
+
+	reply, ok := c.requests[msg.Correlation]
+	if ok {
+		delete(c.requests, msg.Correlation)
+		reply <- msg
+	}
+
+	return ok
+}
+
+// cancelRequests stops any requests waiting on a reply once the connection is gone
+func (c *TCP) cancelRequests() {
+	c.requestTex.Lock()
+	defer c.requestTex.Unlock()
+
+	for correlation, reply := range c.requests {
+		delete(c.requests, correlation)
+		close(reply)
+	}
 }
 
 // List requests a list from the server of the tags this client is subscribed to
 func (c *TCP) List() error {
-	return c.encoder.Encode(&mist.Message{Command: "list"})
+	return c.send(&mist.Message{Command: "list"})
 }
 
 // listall related
 // List requests a list from the server of the tags this client is subscribed to
 func (c *TCP) ListAll() error {
-	return c.encoder.Encode(&mist.Message{Command: "listall"})
+	return c.send(&mist.Message{Command: "listall"})
 }
 
 // who related
 // Who requests connection/subscriber stats from the server
 func (c *TCP) Who() error {
-	return c.encoder.Encode(&mist.Message{Command: "who"})
+	return c.send(&mist.Message{Command: "who"})
 }
 
 // Close closes the client data channel and the connection to the server
@@ -174,7 +464,9 @@ func (c *TCP) Close() {
 	// close(c.messages) // we don't close this in case there is a message waiting in the channel
 }
 
-// Messages ...
+// Messages returns the channel replies and published messages come in on; published
+// messages carry the ID, Seq, Time and Publisher mist stamped them with. Data
+// published as JSON (see PublishJSON) can be decoded with the message's Decode.
 func (c *TCP) Messages() <-chan mist.Message {
 	return c.messages
 }
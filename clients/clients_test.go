@@ -1,13 +1,18 @@
 package clients_test
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/jcelliott/lumber"
 
 	"github.com/nanopack/mist/clients"
+	"github.com/nanopack/mist/internal/testutil"
 	"github.com/nanopack/mist/server"
 )
 
@@ -129,3 +134,296 @@ func TestTCPClient(t *testing.T) {
 		t.Fatalf("Failed to 'list' - %s", msg.Error)
 	}
 }
+
+// TestRequest tests to ensure a request gets the reply of one subscriber, and
+// an error when nobody replies
+func TestRequest(t *testing.T) {
+	requester, err := clients.New(testAddr, "")
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer requester.Close()
+
+	responder, err := clients.New(testAddr, "")
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer responder.Close()
+
+	// reply to anything on "rpc", ignore anything on "silent"
+	responder.Subscribe([]string{"rpc"})
+	responder.Subscribe([]string{"silent"})
+	go func() {
+		for msg := range responder.Messages() {
+			if msg.Command == "request" && msg.Tags[0] == "rpc" {
+				responder.Reply(msg.Correlation, "re:"+msg.Data)
+			}
+		}
+	}()
+	<-time.After(100 * time.Millisecond)
+
+	reply, err := requester.Request([]string{"rpc"}, testMsg, time.Second)
+	if err != nil {
+		t.Fatalf("Request failed - %s", err.Error())
+	}
+	if reply.Data != "re:"+testMsg {
+		t.Fatalf("Unexpected reply - %#v", reply)
+	}
+
+	if _, err := requester.Request([]string{"nobody"}, testMsg, time.Second); err == nil {
+		t.Fatalf("Expected request without subscribers to fail!")
+	}
+
+	start := time.Now()
+	if _, err := requester.Request([]string{"silent"}, testMsg, 200*time.Millisecond); err == nil {
+		t.Fatalf("Expected request to time out!")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Request took too long to time out")
+	}
+}
+
+// TestBinary tests to ensure arbitrary bytes, including newlines and NULs,
+// make it through mist untouched
+func TestBinary(t *testing.T) {
+	publisher, err := clients.New(testAddr, "")
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer publisher.Close()
+
+	subscriber, err := clients.New(testAddr, "")
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer subscriber.Close()
+
+	subscriber.Subscribe([]string{"blob"})
+	<-time.After(100 * time.Millisecond)
+
+	blob := []byte("line one\nline two\x00\xff\r\n")
+	if err := publisher.PublishBinary([]string{"blob"}, blob); err != nil {
+		t.Fatalf("Failed to publish - %s", err.Error())
+	}
+
+	select {
+	case msg := <-subscriber.Messages():
+		if !bytes.Equal(msg.Binary, blob) {
+			t.Fatalf("Unexpected binary - %q", msg.Binary)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for message")
+	}
+}
+
+// TestPublishAfter tests to ensure the server publishes a delayed message even
+// once its publisher is gone, unless it's cancelled
+func TestPublishAfter(t *testing.T) {
+	publisher, err := clients.New(testAddr, "")
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+
+	subscriber, err := clients.New(testAddr, "")
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer subscriber.Close()
+
+	subscriber.Subscribe([]string{"later"})
+	<-time.After(100 * time.Millisecond)
+
+	if err := publisher.PublishAfter([]string{"later"}, "published", 200*time.Millisecond); err != nil {
+		t.Fatalf("Failed to publish - %s", err.Error())
+	}
+	id, err := publisher.PublishAfterID([]string{"later"}, "cancelled", 100*time.Millisecond)
+	if err != nil || id == "" {
+		t.Fatalf("Failed to publish - %v", err)
+	}
+	if err := publisher.Cancel(id); err != nil {
+		t.Fatalf("Failed to cancel - %s", err.Error())
+	}
+	<-time.After(50 * time.Millisecond)
+	publisher.Close()
+
+	select {
+	case msg := <-subscriber.Messages():
+		if msg.Data != "published" {
+			t.Fatalf("Unexpected message - %#v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for message")
+	}
+
+	select {
+	case msg := <-subscriber.Messages():
+		t.Fatalf("Unexpected message - %#v", msg)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// TestHeaders tests to ensure headers are passed along to subscribers untouched
+func TestHeaders(t *testing.T) {
+	publisher, err := clients.New(testAddr, "")
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer publisher.Close()
+
+	subscriber, err := clients.New(testAddr, "")
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer subscriber.Close()
+
+	subscriber.Subscribe([]string{"headers"})
+	<-time.After(100 * time.Millisecond)
+
+	headers := map[string]string{"content-type": "text/plain", "trace-id": "abc123"}
+	if err := publisher.Publish([]string{"headers"}, testMsg, headers); err != nil {
+		t.Fatalf("Failed to publish - %s", err.Error())
+	}
+
+	select {
+	case msg := <-subscriber.Messages():
+		if len(msg.Headers) != 2 || msg.Headers["content-type"] != "text/plain" || msg.Headers["trace-id"] != "abc123" {
+			t.Fatalf("Unexpected headers - %#v", msg.Headers)
+		}
+		if len(msg.Tags) != 1 {
+			t.Fatalf("Unexpected tags - %#v", msg.Tags)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for message")
+	}
+}
+
+// TestPublishJSON tests to ensure JSON values are published as is, and can be
+// decoded by subscribers
+func TestPublishJSON(t *testing.T) {
+	publisher, err := clients.New(testAddr, "")
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer publisher.Close()
+
+	subscriber, err := clients.New(testAddr, "")
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer subscriber.Close()
+
+	subscriber.Subscribe([]string{"json"})
+	<-time.After(100 * time.Millisecond)
+
+	type event struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+
+	if err := publisher.PublishJSON([]string{"json"}, event{"deploy", 3}); err != nil {
+		t.Fatalf("Failed to publish - %s", err.Error())
+	}
+
+	select {
+	case msg := <-subscriber.Messages():
+		if !msg.Raw {
+			t.Fatalf("Expected data to be a JSON value - %#v", msg)
+		}
+
+		e := event{}
+		if err := msg.Decode(&e); err != nil {
+			t.Fatalf("Failed to decode - %s", err.Error())
+		}
+		if e != (event{"deploy", 3}) {
+			t.Fatalf("Unexpected event - %#v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for message")
+	}
+}
+
+// TestTLSClient tests to ensure a client can connect to a tls listener, and
+// that a listener requiring client certificates only allows clients with one
+func TestTLSClient(t *testing.T) {
+	cert, key := testutil.WriteCert(t)
+	defer os.RemoveAll(filepath.Dir(cert))
+
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		t.Fatalf("Failed to load certificate - %s", err.Error())
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(mustParse(pair.Certificate[0], t))
+
+	server.CertFile, server.KeyFile = cert, key
+	defer func() { server.CertFile, server.KeyFile, server.CAFile = "", "", "" }()
+
+	addr := testutil.FreeAddress(t)
+	errChan := make(chan error, 10)
+	server.StartTLS(addr, errChan)
+
+	client, err := clients.NewTLS(addr, "", &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatalf("Client failed to connect - %s", err.Error())
+	}
+	defer client.Close()
+
+	if err := client.Ping(); err != nil {
+		t.Fatalf("ping failed")
+	}
+	if msg := <-client.Messages(); msg.Data != "pong" {
+		t.Fatalf("Unexpected data: Expecting 'pong' got %s", msg.Data)
+	}
+	noErrors(errChan, t)
+
+	// require client certificates signed by the (self-signed) cert
+	server.CAFile = cert
+	mtlsAddr := testutil.FreeAddress(t)
+	mtlsErrChan := make(chan error, 10)
+	server.StartTLS(mtlsAddr, mtlsErrChan)
+	noErrors(mtlsErrChan, t)
+
+	if _, err := clients.NewTLS(mtlsAddr, "", &tls.Config{RootCAs: pool}); err == nil {
+		t.Fatalf("Client without a certificate connected")
+	}
+
+	// the rejected client's failed handshake gets reported
+	select {
+	case <-mtlsErrChan:
+	case <-time.After(time.Second):
+		t.Fatalf("Rejected handshake wasn't reported")
+	}
+
+	client, err = clients.NewTLS(mtlsAddr, "", &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{pair}})
+	if err != nil {
+		t.Fatalf("Client with a certificate failed to connect - %s", err.Error())
+	}
+	defer client.Close()
+
+	if err := client.Ping(); err != nil {
+		t.Fatalf("ping failed")
+	}
+	if msg := <-client.Messages(); msg.Data != "pong" {
+		t.Fatalf("Unexpected data: Expecting 'pong' got %s", msg.Data)
+	}
+	noErrors(mtlsErrChan, t)
+}
+
+// noErrors fails if a listener has reported an error
+func noErrors(errChan chan error, t *testing.T) {
+	select {
+	case err := <-errChan:
+		t.Fatalf("Listener failed - %s", err.Error())
+	default:
+	}
+}
+
+// mustParse parses a DER encoded certificate
+func mustParse(der []byte, t *testing.T) *x509.Certificate {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate - %s", err.Error())
+	}
+	return cert
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/nanopack/mist/auth"
+	"github.com/nanopack/mist/core"
 	"github.com/nanopack/mist/server"
 )
 
@@ -85,6 +86,80 @@ func start(ccmd *cobra.Command, args []string) error {
 		return fmt.Errorf("Failed to start authenticator - %s", err.Error())
 	}
 
+	// keep recently published messages around to replay to new subscriptions
+	mist.HistoryTags = viper.GetInt("history-tags")
+	mist.MaxReplay = viper.GetInt("max-replay")
+	mist.SetHistory(viper.GetInt("history-size"), viper.GetDuration("history-age"))
+	if viper.GetString("storage") != "" {
+		if err := mist.StartStorage(viper.GetString("storage")); err != nil {
+			return fmt.Errorf("Failed to start storage - %s", err.Error())
+		}
+	}
+
+	// how far subscribers can fall behind, and what happens when they do
+	overflow, err := mist.ParseOverflow(viper.GetString("overflow"))
+	if err != nil {
+		return err
+	}
+	if viper.GetInt("queue-size") < 1 {
+		return fmt.Errorf("Invalid queue-size '%d' - must be at least 1", viper.GetInt("queue-size"))
+	}
+	mist.QueueSize = viper.GetInt("queue-size")
+	mist.Overflow = overflow
+
+	// how long ack subscriptions have to ack a message, and how many times it's sent
+	if viper.GetDuration("ack-timeout") <= 0 {
+		return fmt.Errorf("Invalid ack-timeout '%s' - must be more than 0", viper.GetDuration("ack-timeout"))
+	}
+	if viper.GetInt("ack-attempts") < 1 {
+		return fmt.Errorf("Invalid ack-attempts '%d' - must be at least 1", viper.GetInt("ack-attempts"))
+	}
+	mist.AckTimeout = viper.GetDuration("ack-timeout")
+	mist.AckAttempts = viper.GetInt("ack-attempts")
+
+	// what each connection is allowed, and any tokens allowed something else
+	server.DefaultLimits = server.Limits{
+		Subscriptions: viper.GetInt("max-subscriptions"),
+		Tags:          viper.GetInt("max-tags"),
+		PublishRate:   viper.GetFloat64("publish-rate"),
+		PublishBurst:  viper.GetInt("publish-burst"),
+	}
+	server.MaxMessageSize = viper.GetInt64("max-message-size")
+
+	// a list rather than a map, since config keys aren't case sensitive but tokens are
+	var tokenLimits []struct {
+		Token         string `mapstructure:"token"`
+		server.Limits `mapstructure:",squash"`
+	}
+	if err := viper.UnmarshalKey("token-limits", &tokenLimits); err != nil {
+		return fmt.Errorf("Failed to read token limits - %s", err.Error())
+	}
+	for _, limits := range tokenLimits {
+		server.TokenLimits[limits.Token] = limits.Limits
+	}
+
+	// messages published on a schedule; the ones added with the "schedule" command
+	// are saved to the schedule file, the ones in the config start every time
+	if viper.GetString("schedule-file") != "" {
+		if err := mist.LoadSchedules(viper.GetString("schedule-file")); err != nil {
+			return fmt.Errorf("Failed to load schedules - %s", err.Error())
+		}
+	}
+	var schedules []mist.Schedule
+	if err := viper.UnmarshalKey("schedules", &schedules); err != nil {
+		return fmt.Errorf("Failed to read schedules - %s", err.Error())
+	}
+	for _, schedule := range schedules {
+		if _, err := mist.StartSchedule(schedule); err != nil {
+			return err
+		}
+	}
+
+	// the certificate used by TLS listeners that aren't given their own
+	server.CertFile = viper.GetString("tls-cert")
+	server.KeyFile = viper.GetString("tls-key")
+	server.CAFile = viper.GetString("tls-ca")
+
 	if err := server.Start(viper.GetStringSlice("listeners"), viper.GetString("token")); err != nil {
 		return fmt.Errorf("One or more servers failed to start - %s", err.Error())
 	}
@@ -108,6 +183,60 @@ func init() {
 	MistCmd.Flags().StringSlice("listeners", []string{"tcp://127.0.0.1:1445", "ws://127.0.0.1:8888"}, "A comma delimited list of servers to start")
 	viper.BindPFlag("listeners", MistCmd.Flags().Lookup("listeners")) // no reason to have "http://127.0.0.1:8080" too, it only has /ping
 
+	MistCmd.Flags().String("tls-cert", "", "Path to the certificate used by TLS listeners (https, wss, tls) that don't specify their own (?cert=&key=)")
+	viper.BindPFlag("tls-cert", MistCmd.Flags().Lookup("tls-cert"))
+
+	MistCmd.Flags().String("tls-key", "", "Path to the key of the certificate used by TLS listeners")
+	viper.BindPFlag("tls-key", MistCmd.Flags().Lookup("tls-key"))
+
+	MistCmd.Flags().String("tls-ca", "", "Path to a CA that tls listeners require client certificates to be signed by (mTLS)")
+	viper.BindPFlag("tls-ca", MistCmd.Flags().Lookup("tls-ca"))
+
+	MistCmd.Flags().Int("history-size", 0, "Number of messages kept per set of tags for replaying to new subscriptions (0 keeps none unless --history-age is set)")
+	viper.BindPFlag("history-size", MistCmd.Flags().Lookup("history-size"))
+
+	MistCmd.Flags().Duration("history-age", 0, "How long messages are kept for replaying to new subscriptions (e.g. 5m)")
+	viper.BindPFlag("history-age", MistCmd.Flags().Lookup("history-age"))
+
+	MistCmd.Flags().Int("history-tags", mist.HistoryTags, "Number of sets of tags messages are kept for; past that the set published to longest ago is dropped (0 is no limit)")
+	viper.BindPFlag("history-tags", MistCmd.Flags().Lookup("history-tags"))
+
+	MistCmd.Flags().Int("max-replay", mist.MaxReplay, "Most messages replayed to a subscription; asking for more only replays the most recent (0 is no limit)")
+	viper.BindPFlag("max-replay", MistCmd.Flags().Lookup("max-replay"))
+
+	MistCmd.Flags().String("storage", "", "Where published messages are kept for replaying, overriding --history-* (memory://?size=&age= or file:///path?segment-size=&size=&age=&sync=)")
+	viper.BindPFlag("storage", MistCmd.Flags().Lookup("storage"))
+
+	MistCmd.Flags().Int("queue-size", mist.QueueSize, "Number of published messages that can be waiting to be sent to a client")
+	viper.BindPFlag("queue-size", MistCmd.Flags().Lookup("queue-size"))
+
+	MistCmd.Flags().String("overflow", string(mist.Overflow), "What happens to messages for a client whose queue is full (drop-newest, drop-oldest, disconnect)")
+	viper.BindPFlag("overflow", MistCmd.Flags().Lookup("overflow"))
+
+	MistCmd.Flags().Duration("ack-timeout", mist.AckTimeout, "How long a client has to ack a message for an ack subscription before it's sent again")
+	viper.BindPFlag("ack-timeout", MistCmd.Flags().Lookup("ack-timeout"))
+
+	MistCmd.Flags().Int("ack-attempts", mist.AckAttempts, "How many times a message for an ack subscription is sent before it's dropped")
+	viper.BindPFlag("ack-attempts", MistCmd.Flags().Lookup("ack-attempts"))
+
+	MistCmd.Flags().Int("max-subscriptions", 0, "Number of subscriptions a connection can have (0 is unlimited)")
+	viper.BindPFlag("max-subscriptions", MistCmd.Flags().Lookup("max-subscriptions"))
+
+	MistCmd.Flags().Int("max-tags", 0, "Number of tags a subscription can have (0 is unlimited)")
+	viper.BindPFlag("max-tags", MistCmd.Flags().Lookup("max-tags"))
+
+	MistCmd.Flags().Float64("publish-rate", 0, "Number of messages a connection can publish a second (0 is unlimited)")
+	viper.BindPFlag("publish-rate", MistCmd.Flags().Lookup("publish-rate"))
+
+	MistCmd.Flags().Int("publish-burst", 0, "Number of messages a connection can publish at once before --publish-rate applies (defaults to a second's worth)")
+	viper.BindPFlag("publish-burst", MistCmd.Flags().Lookup("publish-burst"))
+
+	MistCmd.Flags().Int64("max-message-size", server.MaxMessageSize, "Largest message (in bytes) a connection can send, for listeners without their own ?max-size= (0 is unlimited)")
+	viper.BindPFlag("max-message-size", MistCmd.Flags().Lookup("max-message-size"))
+
+	MistCmd.Flags().String("schedule-file", "", "Path to a file the schedules added with the 'schedule' command are saved to, so they survive a restart")
+	viper.BindPFlag("schedule-file", MistCmd.Flags().Lookup("schedule-file"))
+
 	MistCmd.Flags().StringVar(&config, "config", config, "Path to config file")
 	viper.BindPFlag("config", MistCmd.Flags().Lookup("config"))
 
@@ -2,6 +2,7 @@ package commands
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -48,7 +49,10 @@ var (
 	}
 )
 
-var data string
+var (
+	data    string
+	headers []string // headers to publish with, as key=value
+)
 
 // init
 func init() {
@@ -63,6 +67,10 @@ func init() {
 	publishCmd.Flags().StringSliceVar(&tags, "tags", tags, "Tags to publish to")
 	messageCmd.Flags().StringSliceVar(&tags, "tags", tags, "Tags to publish to")
 	sendCmd.Flags().StringSliceVar(&tags, "tags", tags, "Tags to publish to")
+
+	publishCmd.Flags().StringArrayVar(&headers, "header", headers, "A header (key=value) to publish with; can be repeated")
+	messageCmd.Flags().StringArrayVar(&headers, "header", headers, "A header (key=value) to message with; can be repeated")
+	sendCmd.Flags().StringArrayVar(&headers, "header", headers, "A header (key=value) to send with; can be repeated")
 }
 
 // publish
@@ -80,13 +88,23 @@ func publish(ccmd *cobra.Command, args []string) error {
 		return fmt.Errorf("")
 	}
 
+	h := map[string]string{}
+	for _, header := range headers {
+		kv := strings.SplitN(header, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			fmt.Printf("Unable to publish - Bad header '%s', expecting key=value\n", header)
+			return fmt.Errorf("")
+		}
+		h[kv[0]] = kv[1]
+	}
+
 	client, err := clients.New(host, viper.GetString("token"))
 	if err != nil {
 		fmt.Printf("Failed to connect to '%s' - %s\n", host, err.Error())
 		return err
 	}
 
-	err = client.Publish(tags, data)
+	err = client.Publish(tags, data, h)
 	if err != nil {
 		fmt.Printf("Failed to publish message - %s\n", err.Error())
 		return err
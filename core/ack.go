@@ -0,0 +1,143 @@
+package mist
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jcelliott/lumber"
+)
+
+var (
+	// AckTimeout is how long a message sent to an ack subscription has to be
+	// acked before it's sent again
+	AckTimeout = 30 * time.Second
+
+	// AckAttempts is how many times a message is sent to an ack subscription
+	// before it's given up on (and counted as dropped)
+	AckAttempts = 5
+
+	// ErrUnknownAck is returned when acking a message that isn't waiting on an ack
+	ErrUnknownAck = fmt.Errorf("Unknown message id")
+)
+
+type (
+
+	// pending is the messages sent to a proxy that are waiting to be acked
+	pending struct {
+		sync.Mutex
+
+		msgs  map[string]*unacked
+		nudge chan bool // wakes the proxy up to start checking for redeliveries
+	}
+
+	// unacked is a message waiting to be acked and when it was last sent
+	unacked struct {
+		msg  Message
+		sent time.Time
+	}
+)
+
+// newPending creates an empty set of pending messages
+func newPending() *pending {
+	return &pending{
+		msgs:  map[string]*unacked{},
+		nudge: make(chan bool, 1),
+	}
+}
+
+// track starts waiting on an ack for a message, returning it stamped as the
+// first attempt; if too many messages are already waiting it isn't tracked
+func (p *pending) track(msg Message) (Message, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	if len(p.msgs) >= QueueSize {
+		return msg, false
+	}
+
+	msg.Attempt = 1
+	p.msgs[msg.ID] = &unacked{msg: msg, sent: time.Now()}
+
+	// let the proxy know there's something to redeliver now
+	if len(p.msgs) == 1 {
+		select {
+		case p.nudge <- true:
+		default:
+		}
+	}
+
+	return msg, true
+}
+
+// ack stops waiting on an ack for a message
+func (p *pending) ack(id string) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if _, ok := p.msgs[id]; !ok {
+		return ErrUnknownAck
+	}
+	delete(p.msgs, id)
+
+	return nil
+}
+
+// due returns the messages that have waited too long for an ack, stamped with
+// their next attempt, and how many were given up on. It also returns whether
+// anything is still waiting.
+func (p *pending) due(now time.Time) (msgs []Message, expired int, waiting bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	for id, u := range p.msgs {
+		if now.Sub(u.sent) < AckTimeout {
+			continue
+		}
+
+		if u.msg.Attempt >= AckAttempts {
+			lumber.Debug("Message '%s' not acked after %d attempts, dropping", id, u.msg.Attempt)
+			delete(p.msgs, id)
+			expired++
+			continue
+		}
+
+		u.msg.Attempt++
+		u.sent = now
+		msgs = append(msgs, u.msg)
+	}
+
+	// send them again in the order they were published
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Seq < msgs[j].Seq })
+
+	return msgs, expired, len(p.msgs) > 0
+}
+
+// prune stops waiting on any messages that keep returns false for
+func (p *pending) prune(keep func(Message) bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	for id, u := range p.msgs {
+		if !keep(u.msg) {
+			delete(p.msgs, id)
+		}
+	}
+}
+
+// Ack acknowledges a message sent to an ack subscription, so it isn't sent again
+func (p *Proxy) Ack(id string) error {
+	lumber.Trace("Proxy acking '%s'...", id)
+
+	return p.pending.ack(id)
+}
+
+// redeliveryInterval is how often a proxy checks for messages to send again
+func redeliveryInterval() time.Duration {
+	if interval := AckTimeout / 10; interval > time.Millisecond {
+		return interval
+	}
+
+	return time.Millisecond
+}
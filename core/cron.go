@@ -0,0 +1,186 @@
+package mist
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// descriptors are shorthands for common cron expressions
+	descriptors = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+
+	months   = map[string]int{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}
+	weekdays = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+)
+
+type (
+	// recurrence is when something happens again
+	recurrence interface {
+		next(after time.Time) time.Time
+	}
+
+	// every recurs at a fixed interval
+	every time.Duration
+
+	// cron recurs on a (standard, five field) cron expression; each field is the
+	// set of values it matches, as bits
+	cron struct {
+		minute, hour, dom, month, dow uint64
+		anyDom, anyDow                bool // the day fields started with "*"
+	}
+)
+
+// parseRecurrence parses a cron expression ("*/5 * * * *"), a descriptor
+// ("@hourly"), or an interval ("@every 30s", or just "30s")
+func parseRecurrence(spec string) (recurrence, error) {
+	spec = strings.TrimSpace(spec)
+
+	interval := strings.TrimSpace(strings.TrimPrefix(spec, "@every"))
+	if d, err := time.ParseDuration(interval); err == nil {
+		if d < time.Second {
+			return nil, fmt.Errorf("Interval '%s' is less than a second", interval)
+		}
+		return every(d), nil
+	}
+
+	if expr, ok := descriptors[spec]; ok {
+		spec = expr
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Expecting 5 fields (minute hour day month weekday) in '%s'", spec)
+	}
+
+	c := &cron{anyDom: strings.HasPrefix(fields[2], "*"), anyDow: strings.HasPrefix(fields[4], "*")}
+
+	var err error
+	if c.minute, err = parseField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if c.hour, err = parseField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if c.dom, err = parseField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if c.month, err = parseField(fields[3], 1, 12, months); err != nil {
+		return nil, err
+	}
+	if c.dow, err = parseField(fields[4], 0, 7, weekdays); err != nil {
+		return nil, err
+	}
+
+	// sunday is 0 or 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+
+	return c, nil
+}
+
+// parseField parses a comma separated list of values ("5"), ranges ("1-5") or
+// "*", each optionally with a step ("*/15", "0-30/10"), into a set of bits
+func parseField(field string, min, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s < 1 {
+				return 0, fmt.Errorf("Bad step in '%s'", field)
+			}
+			step, part = s, part[:i]
+		}
+
+		start, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+
+			var err error
+			if start, err = parseValue(bounds[0], names); err != nil {
+				return 0, fmt.Errorf("Bad value in '%s'", field)
+			}
+			end = start
+			if len(bounds) == 2 {
+				if end, err = parseValue(bounds[1], names); err != nil {
+					return 0, fmt.Errorf("Bad value in '%s'", field)
+				}
+			} else if step > 1 {
+				end = max // "5/15" is every 15 starting at 5
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("'%s' is out of range (%d-%d)", field, min, max)
+		}
+
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+// parseValue parses a number, or a name (like "mon" or "jan")
+func parseValue(value string, names map[string]int) (int, error) {
+	if v, ok := names[strings.ToLower(value)]; ok {
+		return v, nil
+	}
+
+	return strconv.Atoi(value)
+}
+
+// next is the interval after a time
+func (e every) next(after time.Time) time.Time {
+	return after.Add(time.Duration(e))
+}
+
+// next is the first minute after a time the expression matches, or the zero
+// time if it never does (like "0 0 30 2 *")
+func (c *cron) next(after time.Time) time.Time {
+	t := after.Truncate(time.Minute).Add(time.Minute)
+
+	// anything that matches does so within a few years (leap days)
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// matchDay checks the day of the month and of the week; like cron, when both are
+// restricted a day matching either of them matches
+func (c *cron) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+
+	if c.anyDom || c.anyDow {
+		return dom && dow
+	}
+
+	return dom || dow
+}
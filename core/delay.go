@@ -0,0 +1,117 @@
+package mist
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jcelliott/lumber"
+)
+
+var (
+	// ErrUnknownDelayed is returned when cancelling a publish that isn't waiting
+	// to be published (it never was, was already published, or was cancelled)
+	ErrUnknownDelayed = fmt.Errorf("Unknown or already published id")
+
+	// the publishes waiting on their time, by the id they can be cancelled with
+	delayed    = map[string]*delayedPublish{}
+	delayedTex sync.Mutex
+)
+
+type (
+	// delayedPublish is a publish waiting on its time
+	delayedPublish struct {
+		timer *time.Timer
+		token string // the token of the proxy that published it
+	}
+)
+
+// PublishAt publishes the tags, payload (data and binary) and headers of a
+// message at a time, returning an id it can be cancelled with. It's published
+// even if the proxy is closed by then, and can only be cancelled by a proxy with
+// the same token (see Proxy.Cancel).
+func (p *Proxy) PublishAt(msg Message, at time.Time) (string, error) {
+	lumber.Trace("Proxy publishing to %s at %s...", msg.Tags, at)
+
+	if len(msg.Tags) == 0 {
+		return "", fmt.Errorf("Failed to publish. Missing tags")
+	}
+
+	if msg.Raw && msg.Data != "" && !json.Valid([]byte(msg.Data)) {
+		return "", fmt.Errorf("Failed to publish. Data is not valid JSON")
+	}
+
+	// the id is all that's needed to cancel it, so it can't be guessable
+	id, err := newCorrelation()
+	if err != nil {
+		return "", fmt.Errorf("Failed to publish - %s", err.Error())
+	}
+
+	pid := p.id
+	payload := Message{Tags: msg.Tags, Data: msg.Data, Raw: msg.Raw, Binary: msg.Binary, Headers: msg.Headers}
+
+	delayedTex.Lock()
+	defer delayedTex.Unlock()
+
+	d := &delayedPublish{token: p.Token}
+	delayed[id] = d
+	d.timer = time.AfterFunc(time.Until(at), func() {
+		delayedTex.Lock()
+		_, waiting := delayed[id]
+		delete(delayed, id)
+		delayedTex.Unlock()
+
+		// it was cancelled just as it was due
+		if !waiting {
+			return
+		}
+
+		if err := publish(pid, payload); err != nil {
+			lumber.Error("Failed to publish '%s' - %s", id, err.Error())
+		}
+	})
+
+	return id, nil
+}
+
+// Cancel stops a publish waiting on its time (by the id PublishAt returned)
+// from being published, no matter who published it
+func Cancel(id string) error {
+	lumber.Trace("Cancelling publish '%s'...", id)
+
+	return cancel(id, func(*delayedPublish) bool { return true })
+}
+
+// Cancel stops a publish waiting on its time (by the id PublishAt returned)
+// from being published, if it was published with the proxy's token
+func (p *Proxy) Cancel(id string) error {
+	lumber.Trace("Proxy cancelling publish '%s'...", id)
+
+	return cancel(id, func(d *delayedPublish) bool { return d.token == p.Token })
+}
+
+// cancel stops a publish waiting on its time, if allowed is true for it; one
+// that isn't allowed is as unknown as one that doesn't exist
+func cancel(id string, allowed func(*delayedPublish) bool) error {
+	delayedTex.Lock()
+	defer delayedTex.Unlock()
+
+	d, ok := delayed[id]
+	if !ok || !allowed(d) {
+		return ErrUnknownDelayed
+	}
+
+	d.timer.Stop()
+	delete(delayed, id)
+
+	return nil
+}
+
+// Delayed returns how many publishes are waiting on their time
+func Delayed() int {
+	delayedTex.Lock()
+	defer delayedTex.Unlock()
+
+	return len(delayed)
+}
@@ -0,0 +1,404 @@
+package mist
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the default size a segment can grow to before a new one is started
+const defaultSegmentSize = 16 << 20
+
+type (
+
+	// fileStorage is a Storage that appends messages to a log split into segment
+	// files in a directory, so they survive restarts. Each segment is named by
+	// the seq of its first message; retention is enforced by removing whole
+	// segments, oldest first.
+	fileStorage struct {
+		sync.Mutex
+
+		dir         string
+		segmentSize int64         // a new segment is started once the current one is this big
+		size        int64         // the most bytes kept across all segments (0 is no limit)
+		age         time.Duration // how long messages are kept (0 is forever)
+		sync        bool          // whether every append is synced to disk
+
+		segments []*segment // oldest first; the last one is appended to
+		current  *os.File
+	}
+
+	// segment is one file of the log
+	segment struct {
+		first uint64    // the seq of the first message in the segment
+		size  int64     // how big the segment is
+		last  time.Time // when the segment was last appended to
+	}
+
+	// record is a message as it's written to the log, with when it was published
+	record struct {
+		At time.Time `json:"at"`
+		Message
+	}
+)
+
+// newFileStorage creates a new "file" storage
+// (file:///path/to/dir?segment-size=&size=&age=&sync=)
+func newFileStorage(url *url.URL) (Storage, error) {
+	dir := url.Host + url.Path
+	if dir == "" {
+		return nil, fmt.Errorf("Missing directory")
+	}
+
+	size, age, err := retention(url, "size")
+	if err != nil {
+		return nil, err
+	}
+
+	segmentSize := int64(defaultSegmentSize)
+	if value := url.Query().Get("segment-size"); value != "" {
+		if segmentSize, err = strconv.ParseInt(value, 10, 64); err != nil || segmentSize <= 0 {
+			return nil, fmt.Errorf("Invalid segment-size '%s'", value)
+		}
+	}
+
+	return openFileStorage(dir, segmentSize, size, age, url.Query().Get("sync") == "true")
+}
+
+// openFileStorage opens (or creates) the log in dir, picking the seq up from
+// the last message in it
+func openFileStorage(dir string, segmentSize, size int64, age time.Duration, sync bool) (*fileStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("Failed to create directory - %s", err.Error())
+	}
+
+	s := &fileStorage{
+		dir:         dir,
+		segmentSize: segmentSize,
+		size:        size,
+		age:         age,
+		sync:        sync,
+	}
+
+	if err := s.load(); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// load finds the segments in the directory, repairs the last one if a write to
+// it was cut short, and continues the seq from its last message
+func (s *fileStorage) load() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("Failed to read directory - %s", err.Error())
+	}
+
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".log" {
+			continue
+		}
+
+		first, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ".log"), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		s.segments = append(s.segments, &segment{first: first, size: file.Size(), last: file.ModTime()})
+	}
+
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].first < s.segments[j].first })
+
+	// find the last message, dropping anything after it that isn't a whole record
+	for len(s.segments) > 0 {
+		seg := s.segments[len(s.segments)-1]
+
+		// the first message is there even if it can't be read
+		last := seg.first
+		valid, err := s.scan(*seg, func(r record) {
+			last = r.Seq
+		})
+		if err != nil {
+			return err
+		}
+
+		// a segment with nothing in it is from a crash right after starting it
+		if valid == 0 {
+			if err := os.Remove(s.path(seg)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("Failed to remove empty segment - %s", err.Error())
+			}
+			s.segments = s.segments[:len(s.segments)-1]
+			continue
+		}
+
+		if valid < seg.size {
+			if err := os.Truncate(s.path(seg), valid); err != nil {
+				return fmt.Errorf("Failed to repair segment - %s", err.Error())
+			}
+			seg.size = valid
+		}
+
+		if s.current, err = os.OpenFile(s.path(seg), os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return fmt.Errorf("Failed to open segment - %s", err.Error())
+		}
+
+		// the seq only ever goes up, even if the log started over
+		for current := atomic.LoadUint64(&seq); current < last; current = atomic.LoadUint64(&seq) {
+			atomic.CompareAndSwapUint64(&seq, current, last)
+		}
+
+		break
+	}
+
+	return s.retain(time.Now())
+}
+
+// Append stamps a message with the next seq and appends it to the log, starting
+// a new segment if the current one is full. If the message can't be written it's
+// cut back off the log, so a failed publish is never replayed.
+func (s *fileStorage) Append(msg Message) (Message, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	msg = stamp(msg)
+
+	b, err := json.Marshal(record{At: now, Message: msg})
+	if err != nil {
+		return msg, err
+	}
+	b = append(b, '\n')
+
+	if s.current == nil || s.segments[len(s.segments)-1].size+int64(len(b)) > s.segmentSize {
+		if err := s.roll(msg.Seq); err != nil {
+			return msg, err
+		}
+	}
+
+	seg := s.segments[len(s.segments)-1]
+	if _, err := s.current.Write(b); err != nil {
+		return msg, s.rollback(seg, fmt.Errorf("Failed to write message - %s", err.Error()))
+	}
+
+	if s.sync {
+		if err := s.current.Sync(); err != nil {
+			return msg, s.rollback(seg, fmt.Errorf("Failed to sync message - %s", err.Error()))
+		}
+	}
+	seg.size += int64(len(b))
+	seg.last = now
+
+	return msg, s.retain(now)
+}
+
+// Replay returns the messages in the log that match, published after the seq
+// since; if count is more than zero only the last count messages are returned.
+// Messages are returned in the order they were published, along with the last
+// seq stamped when the log was read. The log is only locked while finding what
+// to read, so publishing isn't held up by the segments being read.
+func (s *fileStorage) Replay(match func([]string) bool, count int, since uint64) (msgs []Message, last uint64, err error) {
+	s.Lock()
+	last = atomic.LoadUint64(&seq)
+	segments := make([]segment, len(s.segments))
+	for i, seg := range s.segments {
+		segments[i] = *seg
+	}
+	s.Unlock()
+
+	now := time.Now()
+	for i, seg := range segments {
+
+		// skip segments where everything is before since
+		if i+1 < len(segments) && segments[i+1].first <= since+1 {
+			continue
+		}
+
+		_, err = s.scan(seg, func(r record) {
+			if r.Seq <= since || (s.age > 0 && now.Sub(r.At) > s.age) {
+				return
+			}
+
+			// matching sorts the tags, so they're copied to leave the message alone
+			if !match(append([]string(nil), r.Tags...)) {
+				return
+			}
+
+			msgs = append(msgs, r.Message)
+
+			// don't hold on to more than will be returned
+			if count > 0 && len(msgs) >= 2*count {
+				msgs = append(msgs[:0], msgs[len(msgs)-count:]...)
+			}
+		})
+		if err != nil {
+			return nil, last, err
+		}
+	}
+
+	if count > 0 && len(msgs) > count {
+		msgs = msgs[len(msgs)-count:]
+	}
+
+	return
+}
+
+// Close closes the segment being appended to
+func (s *fileStorage) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.current == nil {
+		return nil
+	}
+
+	err := s.current.Close()
+	s.current = nil
+
+	return err
+}
+
+// rollback cuts a message that failed to be written back off the end of a
+// segment, returning err. If that fails too a new segment is started for the
+// next message, leaving the unfinished one at the end of this one.
+func (s *fileStorage) rollback(seg *segment, err error) error {
+	if terr := s.current.Truncate(seg.size); terr != nil {
+		s.current.Close()
+		s.current = nil
+	}
+
+	return err
+}
+
+// roll starts a new segment, beginning with the message with the seq first
+func (s *fileStorage) roll(first uint64) error {
+	if s.current != nil {
+		if err := s.current.Close(); err != nil {
+			return fmt.Errorf("Failed to close segment - %s", err.Error())
+		}
+		s.current = nil
+	}
+
+	seg := &segment{first: first}
+
+	var err error
+	if s.current, err = os.OpenFile(s.path(seg), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0644); err != nil {
+		return fmt.Errorf("Failed to create segment - %s", err.Error())
+	}
+
+	s.segments = append(s.segments, seg)
+
+	return nil
+}
+
+// retain removes the oldest segments (never the one being appended to) while
+// the log is bigger than allowed, or they only hold messages that are too old
+func (s *fileStorage) retain(now time.Time) error {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+
+	for len(s.segments) > 1 {
+		oldest := s.segments[0]
+
+		expired := s.age > 0 && now.Sub(oldest.last) > s.age
+		if !expired && (s.size <= 0 || total <= s.size) {
+			break
+		}
+
+		if err := os.Remove(s.path(oldest)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Failed to remove segment - %s", err.Error())
+		}
+
+		total -= oldest.size
+		s.segments = s.segments[1:]
+	}
+
+	return nil
+}
+
+// MarshalJSON encodes a record as its message with "at" added, since the
+// message has its own encoding that would otherwise be used for the record
+func (r record) MarshalJSON() ([]byte, error) {
+	msg, err := json.Marshal(r.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	at, err := json.Marshal(r.At)
+	if err != nil {
+		return nil, err
+	}
+
+	// a message always has at least its command
+	b := append([]byte(`{"at":`), at...)
+	b = append(b, ',')
+	return append(b, msg[1:]...), nil
+}
+
+// UnmarshalJSON decodes a record encoded by MarshalJSON
+func (r *record) UnmarshalJSON(b []byte) error {
+	at := struct {
+		At time.Time `json:"at"`
+	}{}
+	if err := json.Unmarshal(b, &at); err != nil {
+		return err
+	}
+	r.At = at.At
+
+	return json.Unmarshal(b, &r.Message)
+}
+
+// scan calls fn with each record in the first seg.size bytes of a segment,
+// returning how many of those bytes are whole lines. A line that isn't a record
+// is skipped; a segment that's been removed (by retention) has nothing in it.
+func (s *fileStorage) scan(seg segment, fn func(record)) (int64, error) {
+	f, err := os.Open(s.path(&seg))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Failed to open segment - %s", err.Error())
+	}
+	defer f.Close()
+
+	var valid int64
+	reader := bufio.NewReader(io.LimitReader(f, seg.size))
+	for {
+		line, err := reader.ReadBytes('\n')
+
+		// a record without a newline was never finished being written
+		if err == io.EOF {
+			return valid, nil
+		}
+		if err != nil {
+			return valid, fmt.Errorf("Failed to read segment - %s", err.Error())
+		}
+		valid += int64(len(line))
+
+		r := record{}
+		if err := json.Unmarshal(line, &r); err != nil {
+			continue
+		}
+
+		fn(r)
+	}
+}
+
+// path is where a segment is stored; names are padded so they sort by seq
+func (s *fileStorage) path(seg *segment) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d.log", seg.first))
+}
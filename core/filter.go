@@ -0,0 +1,246 @@
+package mist
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jcelliott/lumber"
+)
+
+type (
+	// A Filter narrows a subscription down to the messages whose data passes it;
+	// every condition set has to pass. Conditions check all of the data, or one
+	// field of it if it's JSON.
+	Filter struct {
+		Field    string      `json:"field,omitempty"`    // the field of JSON data to check ("level", or "user.name" for nested objects)
+		Equals   interface{} `json:"equals,omitempty"`   // the data (or field) has to be this JSON value
+		Contains string      `json:"contains,omitempty"` // the data (or field) has to contain this
+		Regex    string      `json:"regex,omitempty"`    // the data (or field) has to match this regular expression
+	}
+
+	// filter is a Filter ready to check messages with
+	filter struct {
+		Filter
+
+		path   []string
+		equals interface{} // what Equals decodes to, so it compares like decoded data
+		regex  *regexp.Regexp
+	}
+
+	// filtered is a subscription with a filter
+	filtered struct {
+		tags         []string
+		subscription subscriptions
+		filter       *filter
+		ack          bool // whether messages for the subscription have to be acked
+	}
+)
+
+// newFilter checks a Filter, and gets it ready to check messages with
+func newFilter(f Filter) (*filter, error) {
+	if f.Equals == nil && f.Contains == "" && f.Regex == "" {
+		return nil, fmt.Errorf("Filter has nothing to check")
+	}
+
+	compiled := &filter{Filter: f}
+
+	if f.Field != "" {
+		compiled.path = strings.Split(f.Field, ".")
+	}
+
+	if f.Equals != nil {
+		b, err := json.Marshal(f.Equals)
+		if err != nil {
+			return nil, fmt.Errorf("Bad filter value - %s", err.Error())
+		}
+		if err := json.Unmarshal(b, &compiled.equals); err != nil {
+			return nil, fmt.Errorf("Bad filter value - %s", err.Error())
+		}
+	}
+
+	if f.Regex != "" {
+		regex, err := regexp.Compile(f.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("Bad filter regex - %s", err.Error())
+		}
+		compiled.regex = regex
+	}
+
+	return compiled, nil
+}
+
+// match checks to see if a message's data passes the filter
+func (f *filter) match(msg Message) bool {
+	value, text, ok := f.value(msg)
+	if !ok {
+		return false
+	}
+
+	if f.Equals != nil && !reflect.DeepEqual(value, f.equals) {
+		return false
+	}
+
+	if f.Contains != "" && !strings.Contains(text, f.Contains) {
+		return false
+	}
+
+	if f.regex != nil && !f.regex.MatchString(text) {
+		return false
+	}
+
+	return true
+}
+
+// value is what the filter checks in a message's data: the value and its text
+// (strings are their own text, anything else is its JSON). Fields can only be
+// found in JSON data, published as a JSON value or as a string.
+func (f *filter) value(msg Message) (interface{}, string, bool) {
+	if f.path == nil && !msg.Raw {
+		return msg.Data, msg.Data, true
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(msg.Data), &value); err != nil {
+		return nil, "", false
+	}
+
+	for _, key := range f.path {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, "", false
+		}
+		if value, ok = object[key]; !ok {
+			return nil, "", false
+		}
+	}
+
+	if s, ok := value.(string); ok {
+		return value, s, true
+	}
+
+	b, _ := json.Marshal(value)
+	return value, string(b), true
+}
+
+// SubscribeFilter subscribes to tags, but only messages whose data passes the
+// filter are sent. If ack is set messages have to be acked like with
+// SubscribeAck. Filtered subscriptions don't replay retained messages.
+func (p *Proxy) SubscribeFilter(tags []string, f Filter, ack bool) error {
+	lumber.Trace("Proxy subscribing to '%s' with a filter...", tags)
+
+	if len(tags) == 0 {
+		return nil
+	}
+
+	compiled, err := newFilter(f)
+	if err != nil {
+		return fmt.Errorf("Failed to subscribe - %s", err.Error())
+	}
+
+	// add proxy to subscribers list so it's considered when publishing
+	subscribe(p)
+
+	p.Lock()
+	defer p.Unlock()
+
+	subscription := newPatterns()
+	subscription.Add(append([]string(nil), tags...))
+	p.filtered = append(p.filtered, &filtered{tags: append([]string(nil), tags...), subscription: subscription, filter: compiled, ack: ack})
+
+	p.reindex()
+
+	return nil
+}
+
+// matches checks to see if a message matches one of the proxy's subscriptions,
+// including those with a filter. This has to be called with the proxy locked.
+func (p *Proxy) matches(msg Message, tags []string) bool {
+	if p.subscriptions.Match(tags) {
+		return true
+	}
+
+	for _, f := range p.filtered {
+		if f.subscription.Match(append([]string(nil), tags...)) && f.filter.match(msg) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ackFor checks to see if a message has to be acked, which it does if one of the
+// subscriptions it was matched for is an ack subscription: the group it was sent
+// for, or otherwise the proxy's own subscriptions that match it. This has to be
+// called with the proxy locked.
+func (p *Proxy) ackFor(msg Message, tags []string) bool {
+	if msg.Group != "" {
+		p.groupTex.RLock()
+		defer p.groupTex.RUnlock()
+
+		acks, ok := p.groupAcks[msg.Group]
+		return ok && acks.Match(append([]string(nil), tags...))
+	}
+
+	if p.subscriptions.Match(append([]string(nil), tags...)) && p.acks.Match(append([]string(nil), tags...)) {
+		return true
+	}
+
+	for _, f := range p.filtered {
+		if f.ack && f.subscription.Match(append([]string(nil), tags...)) && f.filter.match(msg) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wantsAck checks to see if any of the proxy's ack subscriptions still match a
+// message's tags. This has to be called with the proxy locked.
+func (p *Proxy) wantsAck(tags []string) bool {
+	if p.acks.Match(append([]string(nil), tags...)) {
+		return true
+	}
+
+	for _, f := range p.filtered {
+		if f.ack && f.subscription.Match(append([]string(nil), tags...)) {
+			return true
+		}
+	}
+
+	p.groupTex.RLock()
+	defer p.groupTex.RUnlock()
+
+	for _, acks := range p.groupAcks {
+		if acks.Match(append([]string(nil), tags...)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// unfilter removes the subscriptions with a filter to tags. This has to be
+// called with the proxy locked.
+func (p *Proxy) unfilter(tags []string) {
+	key := filterKey(tags)
+
+	kept := p.filtered[:0]
+	for _, f := range p.filtered {
+		if filterKey(f.tags) != key {
+			kept = append(kept, f)
+		}
+	}
+	p.filtered = kept
+}
+
+// filterKey is the same for the same set of tags, in any order
+func filterKey(tags []string) string {
+	sorted := append([]string(nil), tags...)
+	sort.Strings(sorted)
+
+	return strings.Join(sorted, "\x00")
+}
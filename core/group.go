@@ -0,0 +1,177 @@
+package mist
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/jcelliott/lumber"
+)
+
+var (
+	// turns is whose turn it is next in each group, and members how many proxies
+	// are in each one; a group is forgotten once its last member leaves
+	turns    = map[string]uint64{}
+	members  = map[string]int{}
+	turnsTex sync.Mutex
+)
+
+// SubscribeGroup subscribes to tags as a member of a group; each message
+// matching the group's subscriptions is sent to only one of its members, taking
+// turns. If ack is set messages have to be acked like with SubscribeAck. Group
+// subscriptions don't replay retained messages, since every member would get
+// them.
+func (p *Proxy) SubscribeGroup(group string, tags []string, ack bool) error {
+	if group == "" {
+		return p.subscribe(tags, 0, 0, ack)
+	}
+
+	lumber.Trace("Proxy subscribing to '%s' in group '%s'...", tags, group)
+
+	if len(tags) == 0 {
+		return nil
+	}
+
+	// add proxy to subscribers list so it's considered when publishing
+	subscribe(p)
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.groupTex.Lock()
+	if p.groups[group] == nil {
+		p.groups[group] = newPatterns()
+		join(group)
+	}
+	p.groups[group].Add(tags)
+	if ack {
+		if p.groupAcks[group] == nil {
+			p.groupAcks[group] = newPatterns()
+		}
+		p.groupAcks[group].Add(tags)
+	}
+	p.groupTex.Unlock()
+
+	p.reindex()
+
+	return nil
+}
+
+// UnsubscribeGroup unsubscribes from tags subscribed to as a member of a group
+func (p *Proxy) UnsubscribeGroup(group string, tags []string) {
+	if group == "" {
+		p.Unsubscribe(tags)
+		return
+	}
+
+	lumber.Trace("Proxy unsubscribing from '%s' in group '%s'...", tags, group)
+
+	if len(tags) == 0 {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.groupTex.Lock()
+	if subscriptions, ok := p.groups[group]; ok {
+		subscriptions.Remove(tags)
+		if len(subscriptions.ToSlice()) == 0 {
+			delete(p.groups, group)
+			leave(group)
+		}
+	}
+	if acks, ok := p.groupAcks[group]; ok {
+		acks.Remove(tags)
+		if len(acks.ToSlice()) == 0 {
+			delete(p.groupAcks, group)
+		}
+	}
+	p.groupTex.Unlock()
+
+	p.reindex()
+	p.pending.prune(func(msg Message) bool {
+		return p.wantsAck(msg.Tags)
+	})
+}
+
+// leaveGroups takes the proxy out of every group it's a member of
+func (p *Proxy) leaveGroups() {
+	p.groupTex.Lock()
+	defer p.groupTex.Unlock()
+
+	for group := range p.groups {
+		leave(group)
+	}
+	p.groups = map[string]subscriptions{}
+	p.groupAcks = map[string]subscriptions{}
+}
+
+// join counts a new member of a group
+func join(group string) {
+	turnsTex.Lock()
+	members[group]++
+	turnsTex.Unlock()
+}
+
+// leave counts a member leaving a group, forgetting the group once it's empty
+func leave(group string) {
+	turnsTex.Lock()
+	defer turnsTex.Unlock()
+
+	if members[group]--; members[group] <= 0 {
+		delete(members, group)
+		delete(turns, group)
+	}
+}
+
+// matchGroups returns the groups the proxy has a subscription matching tags in
+func (p *Proxy) matchGroups(tags []string) (groups []string) {
+	p.groupTex.RLock()
+	defer p.groupTex.RUnlock()
+
+	for group, subscriptions := range p.groups {
+		if subscriptions.Match(append([]string(nil), tags...)) {
+			groups = append(groups, group)
+		}
+	}
+
+	return
+}
+
+// chooseMembers picks which member of each group with a subscription matching
+// tags gets a message, from the candidates for it, returning the group each
+// chosen proxy got it for. A proxy only gets a message once, so one chosen by
+// more than one group gets it for just one of them (each group still counts it
+// as its turn).
+func chooseMembers(pid uint32, candidates []*Proxy, tags []string) map[uint32]string {
+	members := map[string][]uint32{}
+	for _, subscriber := range candidates {
+		if subscriber.id == pid {
+			continue
+		}
+
+		for _, group := range subscriber.matchGroups(tags) {
+			members[group] = append(members[group], subscriber.id)
+		}
+	}
+
+	if len(members) == 0 {
+		return nil
+	}
+
+	chosen := map[uint32]string{}
+
+	turnsTex.Lock()
+	defer turnsTex.Unlock()
+
+	for group, ids := range members {
+
+		// take turns in a stable order
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+		chosen[ids[turns[group]%uint64(len(ids))]] = group
+		turns[group]++
+	}
+
+	return chosen
+}
@@ -0,0 +1,178 @@
+package mist
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HistoryTags is the most sets of tags a history keeps messages for; past that
+// the set published to longest ago is dropped (0 is no limit)
+var HistoryTags = 10000
+
+type (
+
+	// history keeps the most recent messages published to each set of tags, up to
+	// a number of messages and/or for a duration
+	history struct {
+		sync.Mutex
+
+		size    int           // the most messages kept per set of tags (0 is no limit)
+		age     time.Duration // how long messages are kept (0 is forever)
+		tags    int           // the most sets of tags kept (0 is no limit)
+		swept   time.Time     // when expired messages were last dropped from every set
+		buffers map[string][]entry
+	}
+
+	// entry is a message in the history and when it was published
+	entry struct {
+		msg Message
+		at  time.Time
+	}
+)
+
+// SetHistory enables keeping the last [size] messages and/or messages from the
+// last [age] published to each set of tags, so they can be replayed to new
+// subscriptions (the same as starting a "memory://" storage); passing zero for
+// both disables it. This is meant to be called before mist starts publishing.
+func SetHistory(size int, age time.Duration) {
+	if size <= 0 && age <= 0 {
+		setStorage(nil)
+		return
+	}
+
+	setStorage(newHistory(size, age))
+}
+
+// newHistory creates a history that keeps [size] messages per set of tags and/or
+// messages from the last [age]
+func newHistory(size int, age time.Duration) *history {
+	return &history{
+		size:    size,
+		age:     age,
+		tags:    HistoryTags,
+		swept:   time.Now(),
+		buffers: map[string][]entry{},
+	}
+}
+
+// Append stamps a message with the next sequence number and adds it to the
+// history of its tags, dropping any messages that no longer fit. Stamping happens
+// under the lock so a replay never misses a message with a lower sequence number.
+func (h *history) Append(msg Message) (Message, error) {
+	tags := append([]string(nil), msg.Tags...)
+	sort.Strings(tags)
+	key := strings.Join(tags, "\x00")
+
+	h.Lock()
+	defer h.Unlock()
+
+	msg = stamp(msg)
+
+	stored := msg
+	stored.Tags = tags
+
+	now := time.Now()
+
+	// sets of tags that aren't published to anymore would otherwise be kept forever
+	if h.age > 0 && now.Sub(h.swept) > h.age {
+		h.sweep(now)
+	}
+	if _, ok := h.buffers[key]; !ok && h.tags > 0 && len(h.buffers) >= h.tags {
+		h.evict()
+	}
+
+	buffer := append(h.buffers[key], entry{msg: stored, at: now})
+
+	// drop the oldest messages beyond the size of the buffer
+	if h.size > 0 && len(buffer) > h.size {
+		buffer = buffer[len(buffer)-h.size:]
+	}
+
+	h.buffers[key] = h.expire(buffer, now)
+
+	return msg, nil
+}
+
+// Replay returns the messages in the history that match, published after the
+// sequence number since; if count is more than zero only the last count
+// messages are returned. Messages are returned in the order they were published,
+// along with the last sequence number stamped when the history was read.
+func (h *history) Replay(match func([]string) bool, count int, since uint64) (msgs []Message, last uint64, err error) {
+	h.Lock()
+	defer h.Unlock()
+
+	last = atomic.LoadUint64(&seq)
+
+	// take the chance to clean up any tags that haven't been published to in a while
+	h.sweep(time.Now())
+
+	for _, buffer := range h.buffers {
+		for _, e := range buffer {
+			// matching sorts the tags, so they're copied to leave the history alone
+			if e.msg.Seq > since && match(append([]string(nil), e.msg.Tags...)) {
+				msgs = append(msgs, e.msg)
+			}
+		}
+	}
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Seq < msgs[j].Seq })
+
+	if count > 0 && len(msgs) > count {
+		msgs = msgs[len(msgs)-count:]
+	}
+
+	return
+}
+
+// Close drops everything in the history
+func (h *history) Close() error {
+	h.Lock()
+	h.buffers = map[string][]entry{}
+	h.Unlock()
+
+	return nil
+}
+
+// sweep drops the expired messages from every set of tags, and the sets left
+// empty
+func (h *history) sweep(now time.Time) {
+	for key, buffer := range h.buffers {
+		if buffer = h.expire(buffer, now); len(buffer) == 0 {
+			delete(h.buffers, key)
+			continue
+		}
+		h.buffers[key] = buffer
+	}
+
+	h.swept = now
+}
+
+// evict drops the set of tags published to longest ago
+func (h *history) evict() {
+	var oldest string
+	var at time.Time
+	for key, buffer := range h.buffers {
+		if last := buffer[len(buffer)-1].at; at.IsZero() || last.Before(at) {
+			oldest, at = key, last
+		}
+	}
+
+	delete(h.buffers, oldest)
+}
+
+// expire drops the messages from buffer that are older than the history allows
+func (h *history) expire(buffer []entry, now time.Time) []entry {
+	if h.age <= 0 {
+		return buffer
+	}
+
+	i := 0
+	for i < len(buffer) && now.Sub(buffer[i].at) > h.age {
+		i++
+	}
+
+	return buffer[i:]
+}
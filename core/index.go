@@ -0,0 +1,104 @@
+package mist
+
+import (
+	"sort"
+)
+
+var (
+	// index is the proxies that could be interested in a message with a tag, so
+	// publishing only visits those instead of every subscriber. Each subscription
+	// is indexed by one of its tags that every matching message has to have; ones
+	// that are only patterns are indexed under wildcard. It's locked along with
+	// subscribers.
+	index = map[string]map[*Proxy]bool{}
+)
+
+// the key of subscriptions every message could match
+const wildcard = ""
+
+// indexKey is the tag a subscription is indexed by: the first of its tags that
+// isn't a pattern (or exclusion), since a message has to have it to match
+func indexKey(tags []string) string {
+	sorted := append([]string(nil), tags...)
+	sort.Strings(sorted)
+
+	for _, tag := range sorted {
+		if !hasPattern([]string{tag}) {
+			return tag
+		}
+	}
+
+	return wildcard
+}
+
+// reindex updates the index with the proxy's current subscriptions (including
+// group subscriptions and those with a filter), plus any extra ones about to be
+// added. This has to be called with the proxy locked.
+func (p *Proxy) reindex(extra ...[]string) {
+	subscriptions := append(p.subscriptions.ToSlice(), extra...)
+	for _, f := range p.filtered {
+		subscriptions = append(subscriptions, f.tags)
+	}
+
+	p.groupTex.RLock()
+	for _, group := range p.groups {
+		subscriptions = append(subscriptions, group.ToSlice()...)
+	}
+	p.groupTex.RUnlock()
+
+	keys := map[string]bool{}
+	for _, tags := range subscriptions {
+		keys[indexKey(tags)] = true
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for key := range p.indexed {
+		if !keys[key] {
+			unindex(p, key)
+		}
+	}
+
+	for key := range keys {
+		if index[key] == nil {
+			index[key] = map[*Proxy]bool{}
+		}
+		index[key][p] = true
+	}
+
+	p.indexed = keys
+}
+
+// unindex removes a proxy from the index under a key. This has to be called with
+// the subscribers locked.
+func unindex(p *Proxy, key string) {
+	delete(index[key], p)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
+
+// candidates returns the proxies that could have a subscription matching tags.
+// This has to be called with the subscribers locked.
+func candidates(tags []string) (proxies []*Proxy) {
+	seen := map[*Proxy]bool{}
+
+	add := func(key string) {
+		for p := range index[key] {
+			if !seen[p] {
+				seen[p] = true
+				proxies = append(proxies, p)
+			}
+		}
+	}
+
+	add(wildcard)
+	for _, tag := range tags {
+		if tag != wildcard {
+			add(tag)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,65 @@
+package mist
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+type (
+	// message is a Message without its own JSON encoding, so it can be encoded
+	// the default way
+	message Message
+)
+
+// MarshalJSON encodes a message; if Raw is set, Data is a JSON value and is sent
+// as is rather than as a string
+func (m Message) MarshalJSON() ([]byte, error) {
+	if !m.Raw || m.Data == "" {
+		return json.Marshal(message(m))
+	}
+
+	return json.Marshal(struct {
+		message
+		Data json.RawMessage `json:"data,omitempty"`
+	}{message(m), json.RawMessage(m.Data)})
+}
+
+// UnmarshalJSON decodes a message; data that is a string is decoded like
+// always, anything else (an object, array, number, etc.) is kept as it was sent
+// with Raw set
+func (m *Message) UnmarshalJSON(b []byte) error {
+	wire := struct {
+		*message
+		Data json.RawMessage `json:"data,omitempty"`
+	}{message: (*message)(m)}
+
+	if err := json.Unmarshal(b, &wire); err != nil {
+		return err
+	}
+
+	m.Data, m.Raw = "", false
+
+	data := bytes.TrimSpace(wire.Data)
+	switch {
+	case len(data) == 0, string(data) == "null":
+		return nil
+	case data[0] == '"':
+		return json.Unmarshal(data, &m.Data)
+	}
+
+	m.Data, m.Raw = string(data), true
+
+	return nil
+}
+
+// Decode decodes a message's data into v. Data that was published as a JSON
+// value is decoded directly; data that was published as a string is expected to
+// contain JSON, like it had to before messages could carry JSON values.
+func (m Message) Decode(v interface{}) error {
+	if m.Data == "" {
+		return fmt.Errorf("Failed to decode. Missing data")
+	}
+
+	return json.Unmarshal([]byte(m.Data), v)
+}
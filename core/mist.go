@@ -2,9 +2,14 @@
 package mist
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jcelliott/lumber"
@@ -14,16 +19,39 @@ var (
 	mutex       = &sync.RWMutex{}
 	subscribers = make(map[uint32]*Proxy)
 	uid         uint32
+	seq         uint64 // the sequence number of the last published message
+
+	// boot identifies this run of mist, so message IDs stay unique even if the seq
+	// starts over after a restart
+	boot = newBoot()
 )
 
 type (
 	// A Message contains the tags used when subscribing, and the data that is being
 	// published through mist
 	Message struct {
-		Command string   `json:"command"`
-		Tags    []string `json:"tags,omitempty"`
-		Data    string   `json:"data,omitempty"`
-		Error   string   `json:"error,omitempty"`
+		Command     string            `json:"command"`
+		Tags        []string          `json:"tags,omitempty"`
+		Data        string            `json:"data,omitempty"`
+		Raw         bool              `json:"-"`                 // data is a JSON value rather than a string (see MarshalJSON)
+		Binary      []byte            `json:"binary,omitempty"`  // arbitrary bytes, sent base64 encoded
+		Headers     map[string]string `json:"headers,omitempty"` // metadata (content-type, trace ids, etc.) that isn't used for routing
+		Error       string            `json:"error,omitempty"`
+		ID          string            `json:"id,omitempty"`          // unique to each published message
+		Seq         uint64            `json:"seq,omitempty"`         // the order the message was published in
+		Time        *time.Time        `json:"time,omitempty"`        // when mist received the message
+		Publisher   uint32            `json:"publisher,omitempty"`   // the id of the proxy that published the message (0 is mist itself)
+		Replay      int               `json:"replay,omitempty"`      // (subscribe) how many retained messages to replay
+		Since       uint64            `json:"since,omitempty"`       // (subscribe) replay retained messages after this seq
+		Ack         bool              `json:"ack,omitempty"`         // (subscribe) messages have to be acked, or they're sent again
+		Attempt     int               `json:"attempt,omitempty"`     // how many times a message for an ack subscription has been sent
+		Correlation string            `json:"correlation,omitempty"` // (request/reply) matches a reply to its request
+		Timeout     int               `json:"timeout,omitempty"`     // (request) how long to wait for a reply, in milliseconds
+		Group       string            `json:"group,omitempty"`       // (subscribe) only one member of the group gets each message
+		Filter      *Filter           `json:"filter,omitempty"`      // (subscribe) only messages whose data passes the filter are sent
+		Delay       int               `json:"delay,omitempty"`       // (publishAfter) how long to wait before publishing, in milliseconds
+		When        *time.Time        `json:"when,omitempty"`        // (publishAfter) when to publish, instead of after a delay
+		Schedule    string            `json:"schedule,omitempty"`    // (schedule) the cron expression or interval to publish on
 	}
 
 	// HandleFunc ...
@@ -36,7 +64,7 @@ func Subscribers() string {
 
 	// get tags all clients subscribed to
 	for i := range subscribers {
-		s := subscribers[i].subscriptions.ToSlice()
+		s := subscribers[i].List()
 		for j := range s {
 			for k := range s[j] {
 				subs[s[j][k]] = true
@@ -66,6 +94,12 @@ func Who() (int, int) {
 	return len(subs), int(uid)
 }
 
+// Dropped returns how many published messages have been dropped, across all
+// subscribers, because they weren't keeping up
+func Dropped() uint64 {
+	return atomic.LoadUint64(&dropped)
+}
+
 // todo: delete these 2. limiting what is a subscriber makes this not needed
 // if they subscribe to a thing on a reused connection, they wanted to get updates.. hopefully
 //
@@ -73,7 +107,13 @@ func Who() (int, int) {
 // who reuse the publish connection for subscribing (publishes to self)
 func Publish(tags []string, data string) error {
 	lumber.Trace("Publishing...")
-	return publish(0, tags, data)
+	return publish(0, Message{Tags: tags, Data: data})
+}
+
+// PublishBinary publishes arbitrary bytes to ALL subscribers
+func PublishBinary(tags []string, data []byte) error {
+	lumber.Trace("Publishing binary...")
+	return publish(0, Message{Tags: tags, Binary: data})
 }
 
 // PublishAfter publishes to ALL subscribers. Usefull in client applications
@@ -90,50 +130,99 @@ func PublishAfter(tags []string, data string, delay time.Duration) error {
 	return nil
 }
 
-// publish publishes to all subscribers except the one who issued the publish
-func publish(pid uint32, tags []string, data string) error {
+// publish publishes the tags, payload (data and binary) and headers of a message
+// to all subscribers except the one who issued the publish
+func publish(pid uint32, payload Message) error {
+	tags := payload.Tags
 
 	if len(tags) == 0 {
 		return fmt.Errorf("Failed to publish. Missing tags")
 	}
 
+	if payload.Raw && payload.Data != "" && !json.Valid([]byte(payload.Data)) {
+		return fmt.Errorf("Failed to publish. Data is not valid JSON")
+	}
+
+	// create message; it's stamped (and stored if a storage is started) before
+	// being sent so it's the same for every subscriber
+	now := time.Now()
+	msg := Message{Command: "publish", Tags: tags, Data: payload.Data, Raw: payload.Raw, Binary: payload.Binary, Time: &now, Publisher: pid}
+
+	// every subscriber shares the headers, so they're copied in case the
+	// publisher changes them later
+	if len(payload.Headers) > 0 {
+		msg.Headers = make(map[string]string, len(payload.Headers))
+		for k, v := range payload.Headers {
+			msg.Headers[k] = v
+		}
+	}
+	if store != nil {
+		var err error
+		if msg, err = store.Append(msg); err != nil {
+			return fmt.Errorf("Failed to publish. Unable to store message - %s", err.Error())
+		}
+	} else {
+		msg = stamp(msg)
+	}
+
 	// if there are no subscribers, the message goes nowhere
 	//
-	// this could be more optimized, but it might not be an issue unless thousands
-	// of clients are using mist.
-	go func() {
-		mutex.RLock()
-		for _, subscriber := range subscribers {
-			select {
-			case <-subscriber.done:
-				lumber.Trace("Subscriber done")
-				// do nothing?
-
-			default:
-
-				// dont send this message to the publisher who just sent it
-				if subscriber.id == pid {
-					lumber.Trace("Subscriber is publisher, skipping publish")
-					continue
-				}
-
-				// create message
-				msg := Message{Command: "publish", Tags: tags, Data: data}
-
-				// we don't want this operation blocking the range of other subscribers
-				// waiting to get messages
-				go func(p *Proxy, msg Message) {
-					p.check <- msg
-					lumber.Trace("Published message")
-				}(subscriber, msg)
+	// the message is queued for every subscriber before returning (queueing never
+	// blocks), so messages from a publisher reach each subscriber in the order
+	// they were published
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	// only the proxies with a subscription that could match are visited
+	targets := candidates(tags)
+
+	// only one member of each group gets the message
+	chosen := chooseMembers(pid, targets, tags)
+
+	for _, subscriber := range targets {
+		select {
+		case <-subscriber.done:
+			lumber.Trace("Subscriber done")
+			// do nothing?
+
+		default:
+
+			// dont send this message to the publisher who just sent it
+			if subscriber.id == pid {
+				lumber.Trace("Subscriber is publisher, skipping publish")
+				continue
 			}
+
+			// one slow subscriber can't hold up the rest
+			msg := msg
+			msg.Group = chosen[subscriber.id]
+			subscriber.enqueue(msg)
+			lumber.Trace("Published message")
 		}
-		mutex.RUnlock()
-	}()
+	}
 
 	return nil
 }
 
+// stamp gives a message the next seq, and an ID made from it
+func stamp(msg Message) Message {
+	msg.Seq = atomic.AddUint64(&seq, 1)
+	msg.ID = fmt.Sprintf("%s-%d", boot, msg.Seq)
+
+	return msg
+}
+
+// newBoot creates a random identifier for this run of mist
+func newBoot() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		// unlikely, but the time is unique enough
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+
+	return hex.EncodeToString(b)
+}
+
 // subscribe adds a proxy to the list of mist subscribers; we need this so that
 // we can lock this process incase multiple proxies are subscribing at the same
 // time
@@ -152,6 +241,12 @@ func unsubscribe(pid uint32) {
 	lumber.Trace("Removing proxy from subscribers...")
 
 	mutex.Lock()
+	if p, ok := subscribers[pid]; ok {
+		for key := range p.indexed {
+			unindex(p, key)
+		}
+		p.indexed = nil
+	}
 	delete(subscribers, pid)
 	mutex.Unlock()
 }
@@ -1,6 +1,8 @@
 package mist
 
 import (
+	"encoding/json"
+	"fmt"
 	"math/rand"
 	"strings"
 	"testing"
@@ -26,6 +28,117 @@ func BenchmarkPublish(b *testing.B) {
 	}
 }
 
+// BenchmarkFanOutIndexed publishes to one of many idle subscribers, visiting
+// only the candidates from the index
+func BenchmarkFanOutIndexed(b *testing.B) {
+	benchmarkFanOut(b, func(msg Message) {
+		mutex.RLock()
+		for _, p := range candidates(msg.Tags) {
+			p.enqueue(msg)
+		}
+		mutex.RUnlock()
+	})
+}
+
+// BenchmarkFanOutLinear publishes to one of many idle subscribers by matching
+// every subscriber, the way publishing worked before the index (for comparison)
+func BenchmarkFanOutLinear(b *testing.B) {
+	benchmarkFanOut(b, func(msg Message) {
+		mutex.RLock()
+		for _, p := range subscribers {
+			p.RLock()
+			match := p.subscriptions.Match(append([]string(nil), msg.Tags...))
+			p.RUnlock()
+
+			if match {
+				p.enqueue(msg)
+			}
+		}
+		mutex.RUnlock()
+	})
+}
+
+// benchmarkFanOut subscribes 10000 idle proxies to tags of their own, plus one
+// that reads everything, then times fanning out messages for the busy one
+func benchmarkFanOut(b *testing.B, fanOut func(Message)) {
+	proxies := make([]*Proxy, 10000)
+	for i := range proxies {
+		proxies[i] = NewProxy()
+		proxies[i].Subscribe([]string{fmt.Sprintf("idle:%d", i)})
+	}
+
+	busy := NewProxy()
+	busy.Subscribe([]string{"busy"})
+	go func() {
+		for range busy.Pipe {
+		}
+	}()
+
+	defer func() {
+		for _, p := range proxies {
+			p.Close()
+		}
+		busy.Close()
+	}()
+
+	msg := Message{Command: "publish", Tags: []string{"busy", "other"}, Data: testMsg}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		fanOut(msg)
+	}
+}
+
+// TestIndex tests that publishing only visits the proxies that could match
+func TestIndex(t *testing.T) {
+	exact := NewProxy()
+	defer exact.Close()
+
+	pattern := NewProxy()
+	defer pattern.Close()
+
+	idle := NewProxy()
+	defer idle.Close()
+
+	exact.Subscribe([]string{"index", "b"})
+	pattern.Subscribe([]string{"index:*"})
+	idle.Subscribe([]string{"elsewhere"})
+
+	isCandidate := func(p *Proxy, tags ...string) bool {
+		mutex.RLock()
+		defer mutex.RUnlock()
+
+		for _, candidate := range candidates(tags) {
+			if candidate == p {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !isCandidate(exact, "b", "index") || !isCandidate(pattern, "b") {
+		t.Fatalf("Expected proxies to be candidates!")
+	}
+	if isCandidate(idle, "b", "index") {
+		t.Fatalf("Unexpected candidate!")
+	}
+
+	// once unsubscribed (or closed) proxies are no longer candidates
+	exact.Unsubscribe([]string{"index", "b"})
+	idle.Close()
+	if isCandidate(exact, "b", "index") || isCandidate(idle, "elsewhere") {
+		t.Fatalf("Unexpected candidate!")
+	}
+
+	mutex.RLock()
+	_, found := index["elsewhere"]
+	mutex.RUnlock()
+	if found {
+		t.Fatalf("Expected empty index entry to be removed!")
+	}
+}
+
 // TestPublish tests that the publish Publish method publishes to all subscribers
 func TestPublish(t *testing.T) {
 
@@ -55,6 +168,147 @@ func TestPublish(t *testing.T) {
 	verifyNoMessage(p2, t)
 }
 
+// TestPublishOrder tests that messages from a publisher reach every subscriber
+// in the order they were published, even with other publishers publishing at
+// the same time
+func TestPublishOrder(t *testing.T) {
+	const count = 5000
+
+	// no messages should be dropped for falling behind
+	defer func(size int) { QueueSize = size }(QueueSize)
+	QueueSize = 4 * count
+
+	publishers := make([]*Proxy, 4)
+	for i := range publishers {
+		publishers[i] = NewProxy()
+		defer publishers[i].Close()
+	}
+
+	subscribers := make([]*Proxy, 3)
+	for i := range subscribers {
+		subscribers[i] = NewProxy()
+		defer subscribers[i].Close()
+		subscribers[i].Subscribe([]string{"order"})
+	}
+
+	for i, p := range publishers {
+		go func(i int, p *Proxy) {
+			for n := 0; n < count; n++ {
+				p.Publish([]string{"order"}, fmt.Sprintf("%d:%d", i, n))
+			}
+		}(i, p)
+	}
+
+	for _, s := range subscribers {
+		next := make([]int, len(publishers))
+		for received := 0; received < count*len(publishers); received++ {
+			select {
+			case msg := <-s.Pipe:
+				var publisher, n int
+				if _, err := fmt.Sscanf(msg.Data, "%d:%d", &publisher, &n); err != nil {
+					t.Fatalf("Unexpected data - %s", msg.Data)
+				}
+				if n != next[publisher] {
+					t.Fatalf("Out of order: Expected %d:%d received %s", publisher, next[publisher], msg.Data)
+				}
+				next[publisher]++
+			case <-time.After(time.Second * 5):
+				t.Fatalf("Expecting messages, received %d", received)
+			}
+		}
+	}
+}
+
+// TestMessageStamp tests that published messages are stamped with a unique id,
+// when they were received and who published them
+func TestMessageStamp(t *testing.T) {
+	sender := NewProxy()
+	defer sender.Close()
+
+	receiver := NewProxy()
+	defer receiver.Close()
+
+	receiver.Subscribe([]string{"stamp"})
+
+	before := time.Now()
+	sender.Publish([]string{"stamp"}, testMsg)
+	sender.Publish([]string{"stamp"}, testMsg)
+
+	first, second := <-receiver.Pipe, <-receiver.Pipe
+
+	if first.ID == "" || first.ID == second.ID {
+		t.Fatalf("Expected unique ids - '%s' '%s'", first.ID, second.ID)
+	}
+	if first.Time == nil || first.Time.Before(before) {
+		t.Fatalf("Unexpected time - %v", first.Time)
+	}
+	if first.Publisher != sender.id {
+		t.Fatalf("Unexpected publisher: Expecting %d got %d", sender.id, first.Publisher)
+	}
+
+	// messages mist publishes itself have no publisher
+	Publish([]string{"stamp"}, testMsg)
+	if msg := <-receiver.Pipe; msg.Publisher != 0 {
+		t.Fatalf("Unexpected publisher - %d", msg.Publisher)
+	}
+}
+
+// TestMessageJSON tests that data can be a string or a JSON value, and that
+// either survives being encoded and decoded
+func TestMessageJSON(t *testing.T) {
+	for wire, expected := range map[string]Message{
+		`{"command":"publish","data":"hello"}`:       {Command: "publish", Data: "hello"},
+		`{"command":"publish","data":"{\"a\":1}"}`:   {Command: "publish", Data: `{"a":1}`},
+		`{"command":"publish","data":{"a":1}}`:       {Command: "publish", Data: `{"a":1}`, Raw: true},
+		`{"command":"publish","data":[1,2]}`:         {Command: "publish", Data: `[1,2]`, Raw: true},
+		`{"command":"publish","data":42}`:            {Command: "publish", Data: `42`, Raw: true},
+		`{"command":"publish","tags":["a"],"seq":1}`: {Command: "publish", Tags: []string{"a"}, Seq: 1},
+	} {
+		msg := Message{}
+		if err := json.Unmarshal([]byte(wire), &msg); err != nil {
+			t.Fatalf("Failed to decode '%s' - %s", wire, err.Error())
+		}
+		if fmt.Sprint(msg) != fmt.Sprint(expected) {
+			t.Fatalf("Unexpected message from '%s' - %#v", wire, msg)
+		}
+
+		b, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("Failed to encode - %s", err.Error())
+		}
+		if string(b) != wire {
+			t.Fatalf("Unexpected encoding: Expecting '%s' got '%s'", wire, b)
+		}
+
+		// both kinds of data decode the JSON they carry
+		if msg.Data != "" && msg.Data != "hello" {
+			var v interface{}
+			if err := msg.Decode(&v); err != nil {
+				t.Fatalf("Failed to decode data - %s", err.Error())
+			}
+		}
+	}
+
+	// the file storage keeps raw data raw
+	r := record{At: time.Now(), Message: Message{Command: "publish", Data: `{"a":1}`, Raw: true}}
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatalf("Failed to encode record - %s", err.Error())
+	}
+	decoded := record{}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatalf("Failed to decode record - %s", err.Error())
+	}
+	if !decoded.At.Equal(r.At) || !decoded.Raw || decoded.Data != r.Data {
+		t.Fatalf("Unexpected record '%s' - %#v", b, decoded)
+	}
+
+	// raw data has to be JSON
+	if err := publish(0, Message{Tags: []string{"json"}, Data: "{", Raw: true}); err == nil {
+		t.Fatalf("Expected publishing invalid JSON to fail")
+	}
+}
+
 // verifyMessage waits for a message to come to a proxy then tests to see if it's
 // the expected message. After 1 second it assumes no message is coming and fails.
 func verifyMessage(expected string, p *Proxy, t *testing.T) {
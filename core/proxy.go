@@ -1,6 +1,7 @@
 package mist
 
 import (
+	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -8,31 +9,97 @@ import (
 	"github.com/jcelliott/lumber"
 )
 
+// the overflow policies for when a proxy's queue is full
+const (
+	DropNewest OverflowPolicy = "drop-newest" // the message being published is dropped
+	DropOldest OverflowPolicy = "drop-oldest" // the oldest queued message is dropped to make room
+	Disconnect OverflowPolicy = "disconnect"  // the proxy is disconnected (see Slow)
+)
+
+var (
+	// QueueSize is how many published messages can be waiting to be sent to a
+	// proxy before its overflow policy kicks in
+	QueueSize = 1000
+
+	// Overflow is the overflow policy new proxies start with
+	Overflow = DropNewest
+
+	// dropped is how many messages have been dropped across every proxy
+	dropped uint64
+)
+
 type (
+	// OverflowPolicy is what happens to messages published to a proxy that isn't
+	// keeping up with them
+	OverflowPolicy string
+
 	// Proxy ...
 	Proxy struct {
 		sync.RWMutex
 
+		MaxMessageSize int64 // the largest message the proxy's connection can send (0 is unlimited)
+
 		Authenticated bool
+		Token         string // the token the proxy authenticated with
 		Pipe          chan Message
 		check         chan Message
 		done          chan bool
 		id            uint32
+		replays       []replayWindow // the replays live messages may already have been sent in
+		queued        []Message      // replayed messages waiting to be sent
+		flush         chan bool      // nudged when there are replayed messages to send
 		subscriptions subscriptions
+		filtered      []*filtered              // the subscriptions with a filter
+		acks          subscriptions            // the subscriptions (without a filter or group) whose messages have to be acked
+		groups        map[string]subscriptions // the subscriptions made as a member of a group, by group
+		groupAcks     map[string]subscriptions // the group subscriptions whose messages have to be acked, by group
+		groupTex      sync.RWMutex             // groups are matched while publishing, so they have a lock of their own
+		indexed       map[string]bool          // the keys the proxy is indexed under (see reindex)
+		pending       *pending                 // the messages waiting to be acked
+
+		overflow  atomic.Value // the proxy's OverflowPolicy
+		dropped   uint64       // how many messages have been dropped
+		slow      chan bool    // closed when the proxy should be disconnected
+		slowOnce  sync.Once
+		closeOnce sync.Once
+	}
+
+	// replayWindow is a replay sent to a proxy; live messages up to seq last that match
+	// its subscription were either in it or older than what was asked for
+	replayWindow struct {
+		last  uint64
+		match func([]string) bool
 	}
 )
 
+// ParseOverflow parses the name of an overflow policy
+func ParseOverflow(name string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(name); policy {
+	case DropNewest, DropOldest, Disconnect:
+		return policy, nil
+	}
+
+	return "", fmt.Errorf("Unknown overflow policy '%s'", name)
+}
+
 // NewProxy ...
 func NewProxy() (p *Proxy) {
 
 	// create new proxy
 	p = &Proxy{
 		Pipe:          make(chan Message),
-		check:         make(chan Message),
+		check:         make(chan Message, QueueSize),
 		done:          make(chan bool),
+		flush:         make(chan bool, 1),
+		slow:          make(chan bool),
 		id:            atomic.AddUint32(&uid, 1),
-		subscriptions: newNode(),
+		subscriptions: newPatterns(),
+		acks:          newPatterns(),
+		groups:        map[string]subscriptions{},
+		groupAcks:     map[string]subscriptions{},
+		pending:       newPending(),
 	}
+	p.overflow.Store(Overflow)
 
 	p.connect()
 
@@ -51,11 +118,19 @@ func (p *Proxy) connect() {
 func (p *Proxy) handleMessages() {
 
 	defer func() {
-		lumber.Trace("Got p.done, closing check and pipe")
-		close(p.check)
+		lumber.Trace("Got p.done, closing pipe")
 		close(p.Pipe) // don't close pipe (response/pong messages need it), but leaving it unclosed leaves ram bloat on server even after client disconnects
 	}()
 
+	// only check for messages to send again while any are waiting on an ack
+	var ticker *time.Ticker
+	var redeliver <-chan time.Time
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+
 	for {
 		select {
 
@@ -64,14 +139,78 @@ func (p *Proxy) handleMessages() {
 		// across the channel
 		case msg := <-p.check:
 			lumber.Trace("Got p.check")
-			p.RLock()
-			match := p.subscriptions.Match(msg.Tags)
-			p.RUnlock()
+			// matching sorts the tags, and every subscriber has the same message, so
+			// they're matched on a copy
+			tags := append([]string(nil), msg.Tags...)
+
+			// replies are for the proxy no matter what it's subscribed to, as are
+			// requests and messages it was chosen for (as a responder, or a member
+			// of a group) when they were sent; only published
+			// messages can have been replayed or need acking
+			published := msg.Command == "publish"
+
+			// anything replayed has to be sent before live messages are
+			p.Lock()
+			queued := p.queued
+			p.queued = nil
+			match := msg.Command == "reply" || msg.Command == "request" || msg.Group != "" || (p.matches(msg, tags) && (!published || !p.replayed(msg.Seq, tags)))
+			ack := match && published && p.ackFor(msg, tags)
+			p.Unlock()
+
+			if !p.send(queued) {
+				return
+			}
+
+			// messages for ack subscriptions are sent again until they're acked
+			if ack {
+				var ok bool
+				if msg, ok = p.pending.track(msg); !ok {
+					lumber.Trace("Too many messages waiting on an ack, dropping")
+					p.drop()
+					continue
+				}
+			}
 
 			// if there is a subscription for the tags publish the message
 			if match {
 				lumber.Trace("Sending msg on pipe")
-				p.Pipe <- msg
+				if !p.send([]Message{msg}) {
+					return
+				}
+			}
+
+		// a subscription replayed messages
+		case <-p.flush:
+			p.Lock()
+			queued := p.queued
+			p.queued = nil
+			p.Unlock()
+
+			if !p.send(queued) {
+				return
+			}
+
+		// a message is waiting on an ack
+		case <-p.pending.nudge:
+			if ticker == nil {
+				ticker = time.NewTicker(redeliveryInterval())
+				redeliver = ticker.C
+			}
+
+		case now := <-redeliver:
+			msgs, expired, waiting := p.pending.due(now)
+			for i := 0; i < expired; i++ {
+				p.drop()
+			}
+
+			if !waiting {
+				ticker.Stop()
+				ticker, redeliver = nil, nil
+			}
+
+			lumber.Trace("Sending unacked msgs on pipe again")
+			if !p.send(msgs) {
+				return
 			}
 
 		case <-p.done:
@@ -80,22 +219,226 @@ func (p *Proxy) handleMessages() {
 	}
 }
 
+// send sends messages down the pipe, returning false if the proxy was closed
+// first
+func (p *Proxy) send(msgs []Message) bool {
+	for _, msg := range msgs {
+		select {
+		case p.Pipe <- msg:
+		case <-p.done:
+			return false
+		}
+	}
+
+	return true
+}
+
+// replayed returns whether a live message (its seq and sorted tags) was already
+// covered by a replay. Once live messages are past a replay it can't cover any
+// more of them, so it's forgotten.
+func (p *Proxy) replayed(seq uint64, tags []string) bool {
+	covered := false
+	replays := p.replays[:0]
+	for _, r := range p.replays {
+		if seq > r.last {
+			continue
+		}
+		replays = append(replays, r)
+		if r.match(tags) {
+			covered = true
+		}
+	}
+	p.replays = replays
+
+	return covered
+}
+
+// enqueue queues a published message to be matched against the proxy's
+// subscriptions without blocking; if the queue is full the proxy's overflow
+// policy decides what happens
+func (p *Proxy) enqueue(msg Message) {
+	select {
+	case p.check <- msg:
+		return
+	default:
+	}
+
+	switch p.overflow.Load().(OverflowPolicy) {
+
+	// make room by dropping the oldest message; if another publish beat us to the
+	// room, this message is dropped instead
+	case DropOldest:
+		select {
+		case <-p.check:
+		default:
+		}
+		p.drop()
+
+		select {
+		case p.check <- msg:
+		default:
+			p.drop()
+		}
+
+	case Disconnect:
+		p.drop()
+		p.slowOnce.Do(func() {
+			lumber.Debug("Proxy too far behind, disconnecting...")
+			close(p.slow)
+		})
+
+	default:
+		p.drop()
+	}
+}
+
+// offer queues a message without blocking, returning false (and leaving the
+// proxy's overflow policy alone) if the queue is full
+func (p *Proxy) offer(msg Message) bool {
+	select {
+	case p.check <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// drop counts a dropped message
+func (p *Proxy) drop() {
+	atomic.AddUint64(&p.dropped, 1)
+	atomic.AddUint64(&dropped, 1)
+}
+
+// SetOverflow sets what happens to messages published to the proxy once its
+// queue is full
+func (p *Proxy) SetOverflow(policy OverflowPolicy) {
+	p.overflow.Store(policy)
+}
+
+// Dropped returns how many messages published to the proxy have been dropped
+// because it wasn't keeping up
+func (p *Proxy) Dropped() uint64 {
+	return atomic.LoadUint64(&p.dropped)
+}
+
+// Slow is closed when the proxy fell too far behind with the Disconnect overflow
+// policy; whatever is sending the proxy's pipe to a client should disconnect it
+func (p *Proxy) Slow() <-chan bool {
+	return p.slow
+}
+
+// Done is closed once the proxy is closed
+func (p *Proxy) Done() <-chan bool {
+	return p.done
+}
+
 // Subscribe ...
 func (p *Proxy) Subscribe(tags []string) {
+	p.SubscribeReplay(tags, 0, 0)
+}
+
+// SubscribeAck subscribes to tags like SubscribeReplay, but every message sent
+// for the subscription has to be acked (see Ack); a message that isn't acked
+// within AckTimeout is sent again, up to AckAttempts times.
+func (p *Proxy) SubscribeAck(tags []string, replay int, since uint64) error {
+	return p.subscribe(tags, replay, since, true)
+}
+
+// SubscribeReplay subscribes to tags, first sending any retained messages that
+// match them down the pipe: the last [replay] messages, and/or those published
+// after the seq [since]. Live messages wait until the replay has been sent, so
+// nothing arrives out of order or twice; the replay is sent in the background. Nothing is replayed unless a storage is
+// started (see StartStorage and SetHistory); if the replay fails the tags aren't
+// subscribed to.
+func (p *Proxy) SubscribeReplay(tags []string, replay int, since uint64) error {
+	return p.subscribe(tags, replay, since, false)
+}
+
+// subscribe subscribes to tags, replaying any retained messages first and
+// requiring messages to be acked if ack is set
+func (p *Proxy) subscribe(tags []string, replay int, since uint64, ack bool) error {
 	lumber.Trace("Proxy subscribing to '%s'...", tags)
 
 	if len(tags) == 0 {
-		return
+		return nil
 	}
 
 	// add proxy to subscribers list here so not all clients are 'subscribers'
 	// since gets added to a map, there are no duplicates
 	subscribe(p)
 
-	// add tags to subscription
+	// add tags to subscription; the lock is held while the replay is read so live
+	// messages can't be matched until it's queued to be sent
 	p.Lock()
+	defer p.Unlock()
+
+	if ack {
+		p.acks.Add(tags)
+	}
+
+	if store == nil || (replay <= 0 && since == 0) {
+		p.subscriptions.Add(tags)
+		p.reindex()
+		return nil
+	}
+
+	// only replay what matches the new subscription; anything matching an existing
+	// one may have been delivered already
+	existing := p.subscriptions.ToSlice()
+
+	subscription := newPatterns()
+	subscription.Add(tags)
+	previous := newPatterns()
+	for i := range existing {
+		previous.Add(existing[i])
+	}
+
+	match := func(tags []string) bool {
+		return subscription.Match(tags) && !previous.Match(tags)
+	}
+
+	// messages published from here on have to reach the proxy, so it's indexed
+	// for the new tags before the replay is read
+	p.reindex(tags)
+
+	// replays are read into memory, so they're capped
+	if MaxReplay > 0 && (replay <= 0 || replay > MaxReplay) {
+		replay = MaxReplay
+	}
+
+	msgs, last, err := store.Replay(match, replay, since)
+	if err != nil {
+		if ack {
+			p.acks.Remove(tags)
+		}
+		p.reindex()
+		return fmt.Errorf("Failed to replay messages - %s", err.Error())
+	}
+
 	p.subscriptions.Add(tags)
-	p.Unlock()
+
+	// live messages only the new subscription matches, that were published before
+	// the replay, are either in it or older than what was asked for
+	p.replays = append(p.replays, replayWindow{last: last, match: match})
+
+	for _, msg := range msgs {
+		if ack {
+			var ok bool
+			if msg, ok = p.pending.track(msg); !ok {
+				p.drop()
+				continue
+			}
+		}
+		p.queued = append(p.queued, msg)
+	}
+
+	// the replay is sent from handleMessages, without holding up the proxy
+	select {
+	case p.flush <- true:
+	default:
+	}
+
+	return nil
 }
 
 // Unsubscribe ...
@@ -108,47 +451,83 @@ func (p *Proxy) Unsubscribe(tags []string) {
 
 	// remove tags from subscription
 	p.Lock()
+	defer p.Unlock()
+
 	p.subscriptions.Remove(tags)
-	p.Unlock()
+	p.unfilter(tags)
+	p.acks.Remove(tags)
+	p.reindex()
+
+	// stop waiting on acks for messages no ack subscription wants anymore
+	p.pending.prune(func(msg Message) bool {
+		return p.wantsAck(msg.Tags)
+	})
 }
 
 // Publish ...
 func (p *Proxy) Publish(tags []string, data string) error {
 	lumber.Trace("Proxy publishing to %s...", tags)
 
-	return publish(p.id, tags, data)
+	return publish(p.id, Message{Tags: tags, Data: data})
+}
+
+// PublishBinary publishes arbitrary bytes, which are base64 encoded when sent
+// as JSON so they can contain anything (newlines, NULs, etc.)
+func (p *Proxy) PublishBinary(tags []string, data []byte) error {
+	lumber.Trace("Proxy publishing binary to %s...", tags)
+
+	return publish(p.id, Message{Tags: tags, Binary: data})
+}
+
+// PublishMessage publishes the tags, payload (data and binary) and headers of a
+// message
+func (p *Proxy) PublishMessage(msg Message) error {
+	lumber.Trace("Proxy publishing to %s...", msg.Tags)
+
+	return publish(p.id, msg)
 }
 
 // PublishAfter sends a message after [delay]
 func (p *Proxy) PublishAfter(tags []string, data string, delay time.Duration) {
 	go func() {
 		<-time.After(delay)
-		if err := publish(p.id, tags, data); err != nil {
+		if err := publish(p.id, Message{Tags: tags, Data: data}); err != nil {
 			// log this error and continue
 			lumber.Error("Proxy failed to PublishAfter - %s", err.Error())
 		}
 	}()
 }
 
-// List returns a list of all current subscriptions
+// List returns a list of all current subscriptions, including those made as a
+// member of a group
 func (p *Proxy) List() (data [][]string) {
 	lumber.Trace("Proxy listing subscriptions...")
 	p.RLock()
 	data = p.subscriptions.ToSlice()
+	for _, f := range p.filtered {
+		data = append(data, f.tags)
+	}
 	p.RUnlock()
 
+	p.groupTex.RLock()
+	for _, subscriptions := range p.groups {
+		data = append(data, subscriptions.ToSlice()...)
+	}
+	p.groupTex.RUnlock()
+
 	return
 }
 
 // Close ...
 func (p *Proxy) Close() {
-	lumber.Trace("Proxy closing...")
+	p.closeOnce.Do(func() {
+		lumber.Trace("Proxy closing...")
 
-	if len(p.subscriptions.ToSlice()) != 0 {
 		// remove the local p from mist's list of subscribers
 		unsubscribe(p.id)
-	}
+		p.leaveGroups()
 
-	// this closes the goroutine that is matching messages to subscriptions
-	close(p.done)
+		// this closes the goroutine that is matching messages to subscriptions
+		close(p.done)
+	})
 }
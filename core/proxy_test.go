@@ -1,6 +1,9 @@
 package mist
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 // TestSameSubscriber tests to ensure that mist will not send message to the
 // same proxy who publishes them
@@ -170,3 +173,513 @@ func TestTags(t *testing.T) {
 	sender.Publish([]string{"a", "b"}, testMsg)
 	verifyNoMessage(receiver, t)
 }
+
+// TestExcludedTags tests to ensure that mist won't send messages that have a
+// tag a subscription excludes
+func TestExcludedTags(t *testing.T) {
+	sender := NewProxy()
+	defer sender.Close()
+
+	receiver := NewProxy()
+	defer receiver.Close()
+
+	receiver.Subscribe([]string{"logs", "!debug"})
+	sender.Publish([]string{"logs", "debug"}, testMsg)
+	verifyNoMessage(receiver, t)
+
+	sender.Publish([]string{"logs"}, testMsg)
+	verifyMessage(testMsg, receiver, t)
+
+	receiver.Unsubscribe([]string{"!debug", "logs"})
+	sender.Publish([]string{"logs"}, testMsg)
+	verifyNoMessage(receiver, t)
+}
+
+// TestReplay tests to ensure that retained messages are replayed, in order, to
+// new subscriptions that ask for them, before any live messages
+func TestReplay(t *testing.T) {
+	SetHistory(2, 0)
+	defer SetHistory(0, 0)
+
+	sender := NewProxy()
+	defer sender.Close()
+
+	sender.Publish([]string{"replay"}, "0")
+	sender.Publish([]string{"replay"}, "1")
+	sender.Publish([]string{"replay", "other"}, "2")
+	sender.Publish([]string{"elsewhere"}, "x")
+	sender.Publish([]string{"replay"}, "3")
+
+	// only the last 2 messages for each set of tags are kept
+	all := NewProxy()
+	defer all.Close()
+
+	go all.SubscribeReplay([]string{"replay"}, 10, 0)
+	verifyMessage("1", all, t)
+	verifyMessage("2", all, t)
+	verifyMessage("3", all, t)
+
+	sender.Publish([]string{"replay"}, "4")
+	verifyMessage("4", all, t)
+	verifyNoMessage(all, t)
+
+	// once live messages are past the replay it's forgotten
+	all.RLock()
+	replays := len(all.replays)
+	all.RUnlock()
+	if replays != 0 {
+		t.Fatalf("Replay wasn't forgotten. Expecting 0 replays received %d", replays)
+	}
+
+	// subscribing doesn't wait for the replay to be read
+	unread := NewProxy()
+	defer unread.Close()
+
+	done := make(chan error)
+	go func() { done <- unread.SubscribeReplay([]string{"replay"}, 10, 0) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Subscribing waited on the replay to be read!")
+	}
+	unread.Unsubscribe([]string{"replay"})
+	verifyMessage("2", unread, t)
+	verifyMessage("3", unread, t)
+	verifyMessage("4", unread, t)
+
+	// replaying is limited to the last [replay] messages after [since]
+	last := NewProxy()
+	defer last.Close()
+
+	go last.SubscribeReplay([]string{"replay"}, 1, 0)
+	msg := <-last.Pipe
+	if msg.Data != "4" {
+		t.Fatalf("Unexpected data: Expecting '4' got '%s'", msg.Data)
+	}
+
+	since := NewProxy()
+	defer since.Close()
+
+	go since.SubscribeReplay([]string{"replay"}, 0, msg.Seq-1)
+	verifyMessage("4", since, t)
+	verifyNoMessage(since, t)
+
+	// replays are capped
+	defer func(max int) { MaxReplay = max }(MaxReplay)
+	MaxReplay = 1
+
+	capped := NewProxy()
+	defer capped.Close()
+
+	go capped.SubscribeReplay([]string{"replay"}, 0, 1)
+	verifyMessage("4", capped, t)
+	verifyNoMessage(capped, t)
+}
+
+// TestOverflow tests to ensure a proxy's queue is bounded, and that each
+// overflow policy is followed once it's full
+func TestOverflow(t *testing.T) {
+	defer func(size int) { QueueSize = size }(QueueSize)
+	QueueSize = 2
+
+	// fill fills a proxy's queue, with one more message waiting on the pipe
+	fill := func(p *Proxy) {
+		p.Subscribe([]string{"overflow"})
+		p.enqueue(Message{Tags: []string{"overflow"}, Data: "1"})
+		for len(p.check) != 0 {
+			time.Sleep(time.Millisecond)
+		}
+		for _, data := range []string{"2", "3", "4", "5"} {
+			p.enqueue(Message{Tags: []string{"overflow"}, Data: data})
+		}
+	}
+
+	newest := NewProxy()
+	defer newest.Close()
+
+	fill(newest)
+	if newest.Dropped() != 2 {
+		t.Fatalf("Wrong number of drops. Expecting 2 received %d", newest.Dropped())
+	}
+	for _, data := range []string{"1", "2", "3"} {
+		verifyMessage(data, newest, t)
+	}
+
+	oldest := NewProxy()
+	defer oldest.Close()
+
+	oldest.SetOverflow(DropOldest)
+	fill(oldest)
+	if oldest.Dropped() != 2 {
+		t.Fatalf("Wrong number of drops. Expecting 2 received %d", oldest.Dropped())
+	}
+	for _, data := range []string{"1", "4", "5"} {
+		verifyMessage(data, oldest, t)
+	}
+
+	slow := NewProxy()
+	defer slow.Close()
+
+	slow.SetOverflow(Disconnect)
+	fill(slow)
+	select {
+	case <-slow.Slow():
+	default:
+		t.Fatalf("Expected proxy to be disconnected!")
+	}
+
+	if Dropped() < 6 {
+		t.Fatalf("Wrong number of total drops - %d", Dropped())
+	}
+
+	// closing more than once is fine
+	slow.Close()
+}
+
+// TestAck tests to ensure messages for an ack subscription are sent again until
+// they're acked, up to the number of attempts allowed
+func TestAck(t *testing.T) {
+	defer func(timeout time.Duration, attempts int) {
+		AckTimeout, AckAttempts = timeout, attempts
+	}(AckTimeout, AckAttempts)
+	AckTimeout, AckAttempts = 50*time.Millisecond, 3
+
+	sender := NewProxy()
+	defer sender.Close()
+
+	receiver := NewProxy()
+	defer receiver.Close()
+
+	receiver.SubscribeAck([]string{"ack"}, 0, 0)
+	receiver.Subscribe([]string{"noack"})
+
+	// messages for other subscriptions don't need acking
+	sender.Publish([]string{"noack"}, "once")
+	if msg := <-receiver.Pipe; msg.Attempt != 0 {
+		t.Fatalf("Unexpected attempt - %d", msg.Attempt)
+	}
+	if err := receiver.Ack("nothing"); err != ErrUnknownAck {
+		t.Fatalf("Expected unknown ack!")
+	}
+
+	// a message that's acked isn't sent again
+	sender.Publish([]string{"ack"}, "acked")
+	msg := <-receiver.Pipe
+	if msg.Data != "acked" || msg.Attempt != 1 {
+		t.Fatalf("Unexpected message - %#v", msg)
+	}
+
+	msg = <-receiver.Pipe
+	if msg.Data != "acked" || msg.Attempt != 2 {
+		t.Fatalf("Expected message again - %#v", msg)
+	}
+	if err := receiver.Ack(msg.ID); err != nil {
+		t.Fatalf(err.Error())
+	}
+	verifyNoMessage(receiver, t)
+
+	// a message that's never acked is given up on
+	dropped := receiver.Dropped()
+	sender.Publish([]string{"ack"}, "unacked")
+	for attempt := 1; attempt <= AckAttempts; attempt++ {
+		msg := <-receiver.Pipe
+		if msg.Data != "unacked" || msg.Attempt != attempt {
+			t.Fatalf("Unexpected message - %#v", msg)
+		}
+	}
+	verifyNoMessage(receiver, t)
+
+	if receiver.Dropped() != dropped+1 {
+		t.Fatalf("Expected unacked message to be dropped!")
+	}
+
+	// only the subscriptions a message matched decide whether it's acked
+	mixed := NewProxy()
+	defer mixed.Close()
+
+	mixed.Subscribe([]string{"mixed"})
+	if err := mixed.SubscribeFilter([]string{"mixed"}, Filter{Equals: "filtered"}, true); err != nil {
+		t.Fatalf(err.Error())
+	}
+	mixed.SubscribeGroup("ackers", []string{"grouped"}, true)
+	mixed.Subscribe([]string{"grouped"})
+
+	sender.Publish([]string{"mixed"}, "plain")
+	if msg := <-mixed.Pipe; msg.Data != "plain" || msg.Attempt != 0 {
+		t.Fatalf("Unexpected message - %#v", msg)
+	}
+	sender.Publish([]string{"mixed"}, "filtered")
+	if msg := <-mixed.Pipe; msg.Data != "filtered" || msg.Attempt != 1 {
+		t.Fatalf("Unexpected message - %#v", msg)
+	}
+	sender.Publish([]string{"grouped"}, "grouped")
+	if msg := <-mixed.Pipe; msg.Group != "ackers" || msg.Attempt != 1 {
+		t.Fatalf("Unexpected message - %#v", msg)
+	}
+
+	// leaving the group doesn't make the plain subscription to the same tags an
+	// ack subscription, or the other way around
+	mixed.UnsubscribeGroup("ackers", []string{"grouped"})
+	sender.Publish([]string{"grouped"}, "plain")
+	for msg := range mixed.Pipe {
+		if msg.Data == "plain" {
+			if msg.Attempt != 0 {
+				t.Fatalf("Unexpected message - %#v", msg)
+			}
+			break
+		}
+	}
+}
+
+// TestRequest tests to ensure a request goes to exactly one subscriber, and
+// only it can reply
+func TestRequest(t *testing.T) {
+	requester := NewProxy()
+	defer requester.Close()
+
+	r1 := NewProxy()
+	defer r1.Close()
+
+	r2 := NewProxy()
+	defer r2.Close()
+
+	r1.Subscribe([]string{"request"})
+	r2.Subscribe([]string{"request"})
+
+	// long enough to outlast checking the other subscriber got nothing
+	if err := requester.Request([]string{"request"}, testMsg, "1", 5*time.Second); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	var msg Message
+	var responder, other *Proxy
+	select {
+	case msg = <-r1.Pipe:
+		responder, other = r1, r2
+	case msg = <-r2.Pipe:
+		responder, other = r2, r1
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting request, received none!")
+	}
+	verifyNoMessage(other, t)
+
+	if msg.Command != "request" || msg.Correlation == "1" {
+		t.Fatalf("Unexpected request - %#v", msg)
+	}
+
+	if err := other.Reply(msg.Correlation, "nope"); err != ErrUnknownRequest {
+		t.Fatalf("Expected reply from other subscriber to fail!")
+	}
+	if err := responder.Reply(msg.Correlation, "reply"); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	reply := <-requester.Pipe
+	if reply.Command != "reply" || reply.Correlation != "1" || reply.Data != "reply" {
+		t.Fatalf("Unexpected reply - %#v", reply)
+	}
+
+	// nobody replies to this one
+	requester.Request([]string{"request"}, testMsg, "2", 50*time.Millisecond)
+	if reply := <-requester.Pipe; reply.Correlation != "2" || reply.Error != ErrRequestTimeout.Error() {
+		t.Fatalf("Expected request to time out - %#v", reply)
+	}
+
+	// members of a group can respond too
+	member := NewProxy()
+	defer member.Close()
+
+	member.SubscribeGroup("responders", []string{"grouped"}, false)
+	if err := requester.Request([]string{"grouped"}, testMsg, "3", time.Second); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if msg := <-member.Pipe; msg.Command != "request" {
+		t.Fatalf("Unexpected request - %#v", msg)
+	}
+
+	// a responder that's too far behind is skipped
+	defer func(size int) { QueueSize = size }(QueueSize)
+	QueueSize = 1
+
+	busy := NewProxy()
+	defer busy.Close()
+
+	busy.Subscribe([]string{"busy"})
+	busy.enqueue(Message{Command: "publish", Tags: []string{"busy"}, Data: "1"})
+	for len(busy.check) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	busy.enqueue(Message{Command: "publish", Tags: []string{"busy"}, Data: "2"})
+
+	if err := requester.Request([]string{"busy"}, testMsg, "4", time.Second); err != ErrNoResponderAvailable {
+		t.Fatalf("Expected no responder to be available - %v", err)
+	}
+
+	idle := NewProxy()
+	defer idle.Close()
+
+	idle.Subscribe([]string{"busy"})
+	for i := 0; i < 2; i++ {
+		if err := requester.Request([]string{"busy"}, testMsg, "5", time.Second); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if msg := <-idle.Pipe; msg.Command != "request" {
+			t.Fatalf("Unexpected request - %#v", msg)
+		}
+	}
+}
+
+// TestGroups tests to ensure each message is sent to only one member of a
+// group, taking turns, while subscribers outside the group get everything
+func TestGroups(t *testing.T) {
+	sender := NewProxy()
+	defer sender.Close()
+
+	workers := []*Proxy{NewProxy(), NewProxy(), NewProxy()}
+	for _, member := range workers {
+		defer member.Close()
+		member.SubscribeGroup("workers", []string{"jobs"}, false)
+	}
+
+	everything := NewProxy()
+	defer everything.Close()
+	everything.Subscribe([]string{"jobs"})
+
+	for i := 0; i < 6; i++ {
+		sender.Publish([]string{"jobs", "build"}, testMsg)
+	}
+
+	// each member gets 2 of the 6 messages
+	for _, member := range workers {
+		for i := 0; i < 2; i++ {
+			verifyMessage(testMsg, member, t)
+		}
+	}
+	for _, member := range workers {
+		verifyNoMessage(member, t)
+	}
+
+	for i := 0; i < 6; i++ {
+		verifyMessage(testMsg, everything, t)
+	}
+
+	// once unsubscribed, the others share the messages
+	workers[0].UnsubscribeGroup("workers", []string{"jobs"})
+	sender.Publish([]string{"jobs"}, testMsg)
+	sender.Publish([]string{"jobs"}, testMsg)
+	verifyMessage(testMsg, workers[1], t)
+	verifyMessage(testMsg, workers[2], t)
+	verifyNoMessage(workers[0], t)
+
+	// a group is forgotten once its last member leaves
+	workers[1].UnsubscribeGroup("workers", []string{"jobs"})
+	workers[2].Close()
+
+	turnsTex.Lock()
+	_, turn := turns["workers"]
+	_, member := members["workers"]
+	turnsTex.Unlock()
+	if turn || member {
+		t.Fatalf("Expected the empty group to be forgotten!")
+	}
+}
+
+// TestPublishAt tests to ensure a delayed publish is published on time, even
+// once its publisher is closed, unless it's cancelled
+func TestPublishAt(t *testing.T) {
+	sender := NewProxy()
+	sender.Token = "sender"
+	receiver := NewProxy()
+	defer receiver.Close()
+
+	receiver.Subscribe([]string{"delayed"})
+
+	start := time.Now()
+	if _, err := sender.PublishAt(Message{Tags: []string{"delayed"}, Data: "published"}, start.Add(100*time.Millisecond)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	id, err := sender.PublishAt(Message{Tags: []string{"delayed"}, Data: "cancelled"}, start.Add(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// only a proxy with the same token can cancel it
+	if err := receiver.Cancel(id); err != ErrUnknownDelayed {
+		t.Fatalf("Expected cancelling with another token to fail!")
+	}
+	if err := sender.Cancel(id); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err := Cancel(id); err != ErrUnknownDelayed {
+		t.Fatalf("Expected cancelling twice to fail!")
+	}
+	sender.Close()
+
+	msg := <-receiver.Pipe
+	if msg.Data != "published" || time.Since(start) < 100*time.Millisecond {
+		t.Fatalf("Unexpected message - %#v", msg)
+	}
+	if Delayed() != 0 {
+		t.Fatalf("Expected nothing left waiting - %d", Delayed())
+	}
+
+	if _, err := sender.PublishAt(Message{Data: "no tags"}, start); err == nil {
+		t.Fatalf("Expected publishing without tags to fail!")
+	}
+}
+
+// TestFilter tests to ensure a subscription with a filter only gets the
+// messages whose data passes it
+func TestFilter(t *testing.T) {
+	sender := NewProxy()
+	defer sender.Close()
+
+	receiver := NewProxy()
+	defer receiver.Close()
+
+	if err := receiver.SubscribeFilter([]string{"logs"}, Filter{}, false); err == nil {
+		t.Fatalf("Expected a filter without conditions to fail!")
+	}
+	if err := receiver.SubscribeFilter([]string{"logs"}, Filter{Regex: "("}, false); err == nil {
+		t.Fatalf("Expected a bad regex to fail!")
+	}
+
+	receiver.SubscribeFilter([]string{"logs"}, Filter{Field: "level", Equals: "error"}, false)
+	receiver.SubscribeFilter([]string{"logs"}, Filter{Field: "req.status", Equals: 500}, false)
+	receiver.SubscribeFilter([]string{"lines"}, Filter{Regex: "^ERR"}, false)
+	receiver.SubscribeFilter([]string{"lines"}, Filter{Contains: "panic"}, false)
+
+	publish := func(tags []string, data string, raw bool) {
+		if err := sender.PublishMessage(Message{Tags: tags, Data: data, Raw: raw}); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	publish([]string{"logs"}, `{"level":"info"}`, true)
+	publish([]string{"logs"}, `{"level":"error"}`, true)
+	publish([]string{"logs"}, `{"level":"error"}`, false) // JSON published as a string
+	publish([]string{"logs"}, `{"req":{"status":200}}`, true)
+	publish([]string{"logs"}, `{"req":{"status":500}}`, true)
+	publish([]string{"logs"}, `not json`, false)
+	publish([]string{"lines"}, "INFO all good", false)
+	publish([]string{"lines"}, "ERR something broke", false)
+	publish([]string{"lines"}, "WARN about to panic", false)
+
+	for _, expected := range []string{`{"level":"error"}`, `{"level":"error"}`, `{"req":{"status":500}}`, "ERR something broke", "WARN about to panic"} {
+		if msg := <-receiver.Pipe; msg.Data != expected {
+			t.Fatalf("Unexpected data: Expecting '%s' got '%s'", expected, msg.Data)
+		}
+	}
+	verifyNoMessage(receiver, t)
+
+	// filtered subscriptions are listed and unsubscribed like any other
+	if len(receiver.List()) != 4 {
+		t.Fatalf("Unexpected subscriptions - %v", receiver.List())
+	}
+	receiver.Unsubscribe([]string{"lines"})
+	publish([]string{"lines"}, "ERR again", false)
+	verifyNoMessage(receiver, t)
+}
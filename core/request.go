@@ -0,0 +1,195 @@
+package mist
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jcelliott/lumber"
+)
+
+var (
+	// RequestTimeout is how long a request waits for a reply when it isn't given
+	// a timeout of its own
+	RequestTimeout = 30 * time.Second
+
+	// ErrNoResponders is returned when there's nobody subscribed to a request's tags
+	ErrNoResponders = fmt.Errorf("No subscribers for request")
+
+	// ErrNoResponderAvailable is returned when every proxy subscribed to a
+	// request's tags is too far behind to be sent it
+	ErrNoResponderAvailable = fmt.Errorf("No responder available")
+
+	// ErrUnknownRequest is returned when replying to a request that was never
+	// sent to the proxy replying, or has already been replied to (or timed out)
+	ErrUnknownRequest = fmt.Errorf("Unknown or expired request")
+
+	// ErrRequestTimeout is the error a requester gets back when nobody replied in time
+	ErrRequestTimeout = fmt.Errorf("Request timed out")
+
+	// the requests waiting on a reply, by the correlation they were sent with
+	requests   = map[string]*request{}
+	requestTex sync.Mutex
+	requested  uint32 // used to take turns between responders
+)
+
+type (
+	// request is a request waiting on a reply
+	request struct {
+		requester   *Proxy
+		responder   uint32 // the id of the proxy the request was sent to
+		correlation string // the correlation the requester sent the request with
+		tags        []string
+		timer       *time.Timer
+	}
+)
+
+// Request sends data to exactly one proxy (other than p) subscribed to tags,
+// taking turns between them and skipping any whose queue is full. Its reply, or a timeout error, comes back down p's
+// pipe as a "reply" message with the same correlation; a timeout of 0 waits for
+// RequestTimeout.
+func (p *Proxy) Request(tags []string, data, correlation string, timeout time.Duration) error {
+	lumber.Trace("Proxy requesting %s...", tags)
+
+	if len(tags) == 0 {
+		return fmt.Errorf("Failed to request. Missing tags")
+	}
+
+	if timeout <= 0 {
+		timeout = RequestTimeout
+	}
+
+	now := time.Now()
+	msg := Message{Command: "request", Tags: tags, Data: data, Time: &now, Publisher: p.id}
+
+	responders := respondersFor(p.id, msg)
+	if len(responders) == 0 {
+		return ErrNoResponders
+	}
+
+	// the request is sent with a correlation of mist's own; what the requester
+	// sent only has to be unique to it, and this can't be guessed by anyone else
+	id, err := newCorrelation()
+	if err != nil {
+		return fmt.Errorf("Failed to request - %s", err.Error())
+	}
+
+	msg.Correlation = id
+
+	r := &request{
+		requester:   p,
+		correlation: correlation,
+		tags:        tags,
+	}
+
+	requestTex.Lock()
+	requests[id] = r
+	r.timer = time.AfterFunc(timeout, func() {
+		if finish(id) != nil {
+			p.enqueue(Message{Command: "reply", Tags: tags, Correlation: correlation, Error: ErrRequestTimeout.Error()})
+		}
+	})
+	requestTex.Unlock()
+
+	// the request is waiting before it's sent, so it can be replied to right away
+	for _, responder := range responders {
+		requestTex.Lock()
+		r.responder = responder.id
+		requestTex.Unlock()
+
+		if responder.offer(msg) {
+			return nil
+		}
+	}
+
+	finish(id)
+
+	return ErrNoResponderAvailable
+}
+
+// Reply replies to a request sent to p, with the correlation it was sent with
+func (p *Proxy) Reply(correlation, data string) error {
+	lumber.Trace("Proxy replying to '%s'...", correlation)
+
+	requestTex.Lock()
+	r, ok := requests[correlation]
+	sentTo := ok && r.responder == p.id
+	requestTex.Unlock()
+
+	// only the proxy the request was sent to can reply to it
+	if !sentTo || finish(correlation) == nil {
+		return ErrUnknownRequest
+	}
+
+	now := time.Now()
+	r.requester.enqueue(Message{Command: "reply", Tags: r.tags, Data: data, Correlation: r.correlation, Time: &now, Publisher: p.id})
+
+	return nil
+}
+
+// finish stops waiting on a request, returning it if it was still waiting
+func finish(correlation string) *request {
+	requestTex.Lock()
+	defer requestTex.Unlock()
+
+	r, ok := requests[correlation]
+	if !ok {
+		return nil
+	}
+
+	delete(requests, correlation)
+	r.timer.Stop()
+
+	return r
+}
+
+// respondersFor returns the proxies (other than the requester) with a
+// subscription matching a request, in the order they should be tried
+func respondersFor(pid uint32, msg Message) []*Proxy {
+	var responders []*Proxy
+
+	// a proxy locks itself before the subscribers (see reindex), so each one is
+	// only checked after the subscribers are unlocked
+	mutex.RLock()
+	proxies := candidates(msg.Tags)
+	mutex.RUnlock()
+
+	for _, subscriber := range proxies {
+		if subscriber.id == pid {
+			continue
+		}
+
+		subscriber.RLock()
+		match := subscriber.matches(msg, append([]string(nil), msg.Tags...))
+		subscriber.RUnlock()
+
+		if match || len(subscriber.matchGroups(msg.Tags)) > 0 {
+			responders = append(responders, subscriber)
+		}
+	}
+
+	if len(responders) == 0 {
+		return nil
+	}
+
+	// take turns in a stable order
+	sort.Slice(responders, func(i, j int) bool { return responders[i].id < responders[j].id })
+
+	turn := int(atomic.AddUint32(&requested, 1)-1) % len(responders)
+
+	return append(responders[turn:], responders[:turn]...)
+}
+
+// newCorrelation creates a random correlation for a request
+func newCorrelation() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
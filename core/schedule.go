@@ -0,0 +1,271 @@
+package mist
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jcelliott/lumber"
+)
+
+var (
+	// ErrUnknownSchedule is returned when removing a schedule that doesn't exist
+	ErrUnknownSchedule = fmt.Errorf("Unknown schedule id")
+
+	// the recurring publishes, by id
+	schedules    = map[string]*schedule{}
+	scheduleTex  sync.Mutex
+	scheduleFile string // where schedules are saved, so they survive a restart
+)
+
+type (
+	// A Schedule publishes a message on a cron expression ("*/5 * * * *"), a
+	// descriptor ("@hourly") or at an interval ("@every 30s")
+	Schedule struct {
+		ID      string            `json:"id"`
+		Spec    string            `json:"spec"`
+		Tags    []string          `json:"tags"`
+		Data    string            `json:"data,omitempty"`
+		Headers map[string]string `json:"headers,omitempty"`
+	}
+
+	// schedule is a Schedule that's running
+	schedule struct {
+		Schedule
+
+		recurrence recurrence
+		timer      *time.Timer
+		saved      bool // added with AddSchedule (rather than from config), so it's saved
+	}
+)
+
+// AddSchedule starts publishing a message on a schedule, returning it with the
+// id it can be removed with. If a schedule file is loaded it's saved there.
+func AddSchedule(s Schedule) (Schedule, error) {
+	return addSchedule(s, true)
+}
+
+// StartSchedule starts publishing a message on a schedule without saving it to
+// the schedule file (like the schedules in mist's config, which are started
+// every time it is)
+func StartSchedule(s Schedule) (Schedule, error) {
+	return addSchedule(s, false)
+}
+
+// addSchedule starts a schedule, saving it if save is set
+func addSchedule(s Schedule, save bool) (Schedule, error) {
+	lumber.Trace("Scheduling %s on '%s'...", s.Tags, s.Spec)
+
+	sched, err := newSchedule(s, save)
+	if err != nil {
+		return s, err
+	}
+
+	scheduleTex.Lock()
+	defer scheduleTex.Unlock()
+
+	if err := sched.start(); err != nil {
+		return s, err
+	}
+
+	if save {
+		if err := saveSchedules(); err != nil {
+			sched.timer.Stop()
+			delete(schedules, sched.ID)
+			return s, err
+		}
+	}
+
+	return sched.Schedule, nil
+}
+
+// newSchedule checks a schedule, giving it an id if it doesn't have one
+func newSchedule(s Schedule, save bool) (*schedule, error) {
+	if len(s.Tags) == 0 {
+		return nil, fmt.Errorf("Failed to schedule. Missing tags")
+	}
+
+	r, err := parseRecurrence(s.Spec)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to schedule. Bad spec - %s", err.Error())
+	}
+
+	if r.next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("Failed to schedule. '%s' never happens", s.Spec)
+	}
+
+	if s.ID == "" {
+		if s.ID, err = newCorrelation(); err != nil {
+			return nil, fmt.Errorf("Failed to schedule - %s", err.Error())
+		}
+	}
+
+	return &schedule{Schedule: s, recurrence: r, saved: save}, nil
+}
+
+// RemoveSchedule stops a schedule (by id)
+func RemoveSchedule(id string) error {
+	lumber.Trace("Removing schedule '%s'...", id)
+
+	scheduleTex.Lock()
+	defer scheduleTex.Unlock()
+
+	sched, ok := schedules[id]
+	if !ok {
+		return ErrUnknownSchedule
+	}
+
+	sched.timer.Stop()
+	delete(schedules, id)
+
+	if sched.saved {
+		return saveSchedules()
+	}
+
+	return nil
+}
+
+// Schedules returns the running schedules, by id
+func Schedules() []Schedule {
+	scheduleTex.Lock()
+	defer scheduleTex.Unlock()
+
+	list := make([]Schedule, 0, len(schedules))
+	for _, sched := range schedules {
+		list = append(list, sched.Schedule)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+	return list
+}
+
+// LoadSchedules starts the schedules saved in a file, and saves any added from
+// now on to it; the file is created if it doesn't exist. A saved schedule that
+// can't be started is logged and left out of the file.
+func LoadSchedules(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to read schedules - %s", err.Error())
+	}
+
+	// each schedule is decoded on its own, so one bad one doesn't stop the rest
+	var saved []json.RawMessage
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &saved); err != nil {
+			return fmt.Errorf("Failed to decode schedules - %s", err.Error())
+		}
+	}
+
+	scheduleTex.Lock()
+	defer scheduleTex.Unlock()
+
+	scheduleFile = path
+
+	for i := range saved {
+		s := Schedule{}
+		err := json.Unmarshal(saved[i], &s)
+
+		var sched *schedule
+		if err == nil {
+			sched, err = newSchedule(s, true)
+		}
+		if err == nil {
+			err = sched.start()
+		}
+
+		if err != nil {
+			lumber.Error("Skipping saved schedule '%s' - %s", saved[i], err.Error())
+		}
+	}
+
+	// saved once everything's started, which also makes sure it can be saved to
+	// now rather than the first time it changes
+	return saveSchedules()
+}
+
+// start starts waiting on a schedule. This has to be called with the schedules
+// locked.
+func (s *schedule) start() error {
+	if _, ok := schedules[s.ID]; ok {
+		return fmt.Errorf("Failed to schedule. Schedule '%s' already exists", s.ID)
+	}
+
+	schedules[s.ID] = s
+	s.wait(time.Now())
+
+	return nil
+}
+
+// wait waits for the next time the schedule is due, after a time. This has to be
+// called with the schedules locked.
+func (s *schedule) wait(after time.Time) {
+	next := s.recurrence.next(after)
+	if next.IsZero() {
+		lumber.Error("Schedule '%s' ('%s') won't run again", s.ID, s.Spec)
+		return
+	}
+
+	s.timer = time.AfterFunc(time.Until(next), func() { s.run(next) })
+}
+
+// run publishes a schedule's message, and waits for the next time it's due
+func (s *schedule) run(due time.Time) {
+	scheduleTex.Lock()
+	if schedules[s.ID] != s {
+		scheduleTex.Unlock()
+		return
+	}
+	s.wait(due)
+	scheduleTex.Unlock()
+
+	if err := publish(0, Message{Tags: s.Tags, Data: s.Data, Headers: s.Headers}); err != nil {
+		lumber.Error("Schedule '%s' failed to publish - %s", s.ID, err.Error())
+	}
+}
+
+// saveSchedules writes the schedules added with AddSchedule to the schedule
+// file, if there is one. This has to be called with the schedules locked.
+func saveSchedules() error {
+	if scheduleFile == "" {
+		return nil
+	}
+
+	saved := []Schedule{}
+	for _, sched := range schedules {
+		if sched.saved {
+			saved = append(saved, sched.Schedule)
+		}
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].ID < saved[j].ID })
+
+	b, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to encode schedules - %s", err.Error())
+	}
+
+	// written to a temporary file first, so a crash can't leave it half written
+	tmp, err := ioutil.TempFile(filepath.Dir(scheduleFile), filepath.Base(scheduleFile))
+	if err != nil {
+		return fmt.Errorf("Failed to save schedules - %s", err.Error())
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Failed to save schedules - %s", err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Failed to save schedules - %s", err.Error())
+	}
+
+	if err := os.Rename(tmp.Name(), scheduleFile); err != nil {
+		return fmt.Errorf("Failed to save schedules - %s", err.Error())
+	}
+
+	return nil
+}
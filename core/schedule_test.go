@@ -0,0 +1,167 @@
+package mist
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestRecurrence tests parsing cron expressions and intervals, and when they
+// happen next
+func TestRecurrence(t *testing.T) {
+	// a wednesday
+	now := time.Date(2025, time.January, 1, 10, 30, 15, 0, time.UTC)
+
+	for spec, expected := range map[string]time.Time{
+		"* * * * *":       time.Date(2025, time.January, 1, 10, 31, 0, 0, time.UTC),
+		"*/15 * * * *":    time.Date(2025, time.January, 1, 10, 45, 0, 0, time.UTC),
+		"0 9-17 * * *":    time.Date(2025, time.January, 1, 11, 0, 0, 0, time.UTC),
+		"0 0 * * mon-fri": time.Date(2025, time.January, 2, 0, 0, 0, 0, time.UTC),
+		"0 0 * * 7":       time.Date(2025, time.January, 5, 0, 0, 0, 0, time.UTC),
+		"0 0 15 * mon":    time.Date(2025, time.January, 6, 0, 0, 0, 0, time.UTC), // either day matches
+		"0 0 29 feb *":    time.Date(2028, time.February, 29, 0, 0, 0, 0, time.UTC),
+		"5,10 1 1 1 *":    time.Date(2026, time.January, 1, 1, 5, 0, 0, time.UTC),
+		"@hourly":         time.Date(2025, time.January, 1, 11, 0, 0, 0, time.UTC),
+		"@every 90s":      now.Add(90 * time.Second),
+		"10m":             now.Add(10 * time.Minute),
+	} {
+		r, err := parseRecurrence(spec)
+		if err != nil {
+			t.Fatalf("Failed to parse '%s' - %s", spec, err.Error())
+		}
+		if next := r.next(now); !next.Equal(expected) {
+			t.Fatalf("Unexpected next for '%s': Expecting %s got %s", spec, expected, next)
+		}
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * * * * *", "*/0 * * * *", "5-1 * * * *", "@every 10ms", "@sometimes"} {
+		if _, err := parseRecurrence(spec); err == nil {
+			t.Fatalf("Expected '%s' to fail to parse", spec)
+		}
+	}
+}
+
+// TestSchedules tests to ensure schedules publish their message, and that the
+// ones added are saved and can be loaded again
+func TestSchedules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mist-schedules")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "schedules.json")
+	if err := LoadSchedules(path); err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer func() { scheduleFile = "" }()
+
+	receiver := NewProxy()
+	defer receiver.Close()
+	receiver.Subscribe([]string{"tick"})
+
+	saved, err := AddSchedule(Schedule{Spec: "@every 1s", Tags: []string{"tick"}, Data: "tick"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	started, err := StartSchedule(Schedule{Spec: "@daily", Tags: []string{"daily"}})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if _, err := AddSchedule(Schedule{Spec: "0 0 30 2 *", Tags: []string{"never"}}); err == nil {
+		t.Fatalf("Expected a schedule that never happens to fail")
+	}
+	if _, err := AddSchedule(Schedule{Spec: "@hourly"}); err == nil {
+		t.Fatalf("Expected a schedule without tags to fail")
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-receiver.Pipe:
+			if msg.Data != "tick" || msg.Publisher != 0 {
+				t.Fatalf("Unexpected message - %#v", msg)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expecting scheduled message, received none!")
+		}
+	}
+
+	if len(Schedules()) != 2 {
+		t.Fatalf("Unexpected schedules - %#v", Schedules())
+	}
+
+	// only the added schedule is saved
+	RemoveSchedule(started.ID)
+	RemoveSchedule(saved.ID)
+	if err := RemoveSchedule(saved.ID); err != ErrUnknownSchedule {
+		t.Fatalf("Expected removing twice to fail")
+	}
+	verifyNoMessage(receiver, t)
+
+	if _, err := AddSchedule(Schedule{ID: "kept", Spec: "@hourly", Tags: []string{"hourly"}}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	RemoveSchedule("kept")
+	if _, err := AddSchedule(Schedule{ID: "kept", Spec: "@weekly", Tags: []string{"weekly"}}); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// forget it (without saving) and load it again
+	scheduleTex.Lock()
+	schedules["kept"].timer.Stop()
+	delete(schedules, "kept")
+	scheduleTex.Unlock()
+
+	if err := LoadSchedules(path); err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer RemoveSchedule("kept")
+
+	list := Schedules()
+	if len(list) != 1 || list[0].ID != "kept" || list[0].Spec != "@weekly" || list[0].Tags[0] != "weekly" {
+		t.Fatalf("Unexpected schedules - %#v", list)
+	}
+}
+
+// TestLoadSchedules tests to ensure saved schedules that can't be started are
+// skipped, rather than stopping the rest from loading
+func TestLoadSchedules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mist-schedules")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "schedules.json")
+	saved := `[
+		{"id": "bad-spec", "spec": "sometimes", "tags": ["a"]},
+		{"id": "good", "spec": "@hourly", "tags": ["a"]},
+		{"id": "bad-tags", "spec": "@hourly", "tags": "a"}
+	]`
+	if err := ioutil.WriteFile(path, []byte(saved), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if err := LoadSchedules(path); err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer func() { scheduleFile = "" }()
+	defer RemoveSchedule("good")
+
+	if list := Schedules(); len(list) != 1 || list[0].ID != "good" {
+		t.Fatalf("Unexpected schedules - %#v", list)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	list := []Schedule{}
+	if err := json.Unmarshal(b, &list); err != nil || len(list) != 1 || list[0].ID != "good" {
+		t.Fatalf("Unexpected saved schedules - %s", b)
+	}
+}
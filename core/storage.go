@@ -0,0 +1,126 @@
+package mist
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// store is where published messages are kept so they can be replayed to new
+	// subscriptions; it's nil (and nothing is kept) unless a storage is started
+	store Storage
+
+	// MaxReplay is the most messages replayed to a subscription; one that asks for
+	// more (or for everything after a seq) only gets the most recent MaxReplay
+	// (0 is no limit)
+	MaxReplay = 10000
+
+	// the list of available storages
+	storages   = map[string]storageFunc{}
+	storageTex sync.RWMutex
+)
+
+type (
+	storageFunc func(url *url.URL) (Storage, error)
+
+	// Storage represents somewhere published messages are kept, so they can be
+	// replayed to subscriptions. A storage stamps each message it keeps with the
+	// next sequence number.
+	Storage interface {
+		Append(msg Message) (Message, error)                                                  // stamp a message with the next seq and keep it
+		Replay(match func([]string) bool, count int, since uint64) ([]Message, uint64, error) // the (last count) messages that match after since, and the last seq stamped
+		Close() error                                                                         // release anything the storage holds on to
+	}
+)
+
+// add "memory" and "file" to the list of supported storages
+func init() {
+	RegisterStorage("memory", newMemoryStorage)
+	RegisterStorage("file", newFileStorage)
+}
+
+// RegisterStorage registers a new mist storage
+func RegisterStorage(name string, storage storageFunc) {
+	storageTex.Lock()
+	storages[name] = storage
+	storageTex.Unlock()
+}
+
+// StartStorage attempts to start a mist storage from the list of available
+// storages, replacing any storage already started; the storage provided is in
+// the uri string format (scheme:[//[user:pass@]host[:port]][/]path[?query]). An
+// empty uri stops keeping messages. This is meant to be called before mist
+// starts publishing.
+func StartStorage(uri string) error {
+
+	// no storage is wanted
+	if uri == "" {
+		return setStorage(nil)
+	}
+
+	// parse the uri string into a url object
+	url, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+
+	// check to see if the scheme is supported
+	storageTex.RLock()
+	storage, ok := storages[url.Scheme]
+	storageTex.RUnlock()
+	if !ok {
+		return fmt.Errorf("Unsupported scheme '%s'", url.Scheme)
+	}
+
+	s, err := storage(url)
+	if err != nil {
+		return err
+	}
+
+	return setStorage(s)
+}
+
+// setStorage replaces the current storage, closing the old one
+func setStorage(s Storage) error {
+	old := store
+	store = s
+
+	if old != nil {
+		return old.Close()
+	}
+
+	return nil
+}
+
+// newMemoryStorage creates a new "memory" storage (memory://?size=&age=)
+func newMemoryStorage(url *url.URL) (Storage, error) {
+	size, age, err := retention(url, "size")
+	if err != nil {
+		return nil, err
+	}
+
+	return newHistory(int(size), age), nil
+}
+
+// retention parses how much a storage keeps from the query of its uri: a count
+// or number of bytes (named by [limit]) and an age (?age=, e.g. 5m)
+func retention(url *url.URL, limit string) (size int64, age time.Duration, err error) {
+	query := url.Query()
+
+	if value := query.Get(limit); value != "" {
+		if size, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("Invalid %s '%s'", limit, value)
+		}
+	}
+
+	if value := query.Get("age"); value != "" {
+		if age, err = time.ParseDuration(value); err != nil {
+			return 0, 0, fmt.Errorf("Invalid age '%s'", value)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,206 @@
+package mist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStartStorage tests to ensure storages are started from their uri
+func TestStartStorage(t *testing.T) {
+	defer StartStorage("")
+
+	if err := StartStorage("memory://?size=10&age=1m"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, ok := store.(*history); !ok {
+		t.Fatalf("Expected a memory storage!")
+	}
+
+	if err := StartStorage("memory://?age=soon"); err == nil {
+		t.Fatalf("Expected invalid age to fail!")
+	}
+
+	if err := StartStorage("nowhere://"); err == nil {
+		t.Fatalf("Expected unsupported scheme to fail!")
+	}
+}
+
+// TestHistory tests to ensure the history doesn't keep sets of tags that aren't
+// published to anymore
+func TestHistory(t *testing.T) {
+	defer func(tags int) { HistoryTags = tags }(HistoryTags)
+	HistoryTags = 2
+
+	h := newHistory(1, 0)
+	for _, tag := range []string{"a", "b", "a", "c"} {
+		h.Append(Message{Command: "publish", Tags: []string{tag}, Data: tag})
+	}
+	if _, ok := h.buffers["b"]; ok || len(h.buffers) != 2 {
+		t.Fatalf("Expected the set published to longest ago to be dropped - %v", h.buffers)
+	}
+
+	h = newHistory(0, 10*time.Millisecond)
+	h.Append(Message{Command: "publish", Tags: []string{"a"}, Data: "a"})
+	time.Sleep(20 * time.Millisecond)
+	h.Append(Message{Command: "publish", Tags: []string{"b"}, Data: "b"})
+	if _, ok := h.buffers["a"]; ok {
+		t.Fatalf("Expected the expired set to be dropped - %v", h.buffers)
+	}
+}
+
+// TestFileStorage tests to ensure the file storage keeps messages across
+// restarts, continuing the seq, and enforces retention
+func TestFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mist")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// tiny segments so every message is in a segment of its own
+	s, err := openFileStorage(dir, 1, 0, 0, false)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	var first Message
+	for i, data := range []string{"1", "2", "3"} {
+		msg, err := s.Append(Message{Command: "publish", Tags: []string{"file"}, Data: data})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if i == 0 {
+			first = msg
+		}
+	}
+	s.Append(Message{Command: "publish", Tags: []string{"other"}, Data: "x"})
+	s.Close()
+
+	if segments, _ := filepath.Glob(filepath.Join(dir, "*.log")); len(segments) != 4 {
+		t.Fatalf("Wrong number of segments. Expecting 4 received %d", len(segments))
+	}
+
+	// simulate a crash partway through writing a message
+	f, err := os.OpenFile(filepath.Join(dir, segmentName(first.Seq+3)), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	f.WriteString(`{"at":"2016-`)
+	f.Close()
+
+	// reopening picks up where the log left off
+	s, err = openFileStorage(dir, 1, 0, 0, false)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer s.Close()
+
+	match := func(tags []string) bool { return len(tags) == 1 && tags[0] == "file" }
+
+	msgs, last, err := s.Replay(match, 0, first.Seq)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(msgs) != 2 || msgs[0].Data != "2" || msgs[1].Data != "3" {
+		t.Fatalf("Unexpected replay - %#v", msgs)
+	}
+	if last < first.Seq+3 {
+		t.Fatalf("Seq went backwards - %d", last)
+	}
+
+	msg, err := s.Append(Message{Command: "publish", Tags: []string{"file"}, Data: "4"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if msg.Seq != last+1 {
+		t.Fatalf("Unexpected seq: Expecting %d got %d", last+1, msg.Seq)
+	}
+
+	msgs, _, _ = s.Replay(match, 1, 0)
+	if len(msgs) != 1 || msgs[0].Data != "4" {
+		t.Fatalf("Unexpected replay - %#v", msgs)
+	}
+
+	// limiting the size removes the oldest segments
+	s.size = 1
+	s.Append(Message{Command: "publish", Tags: []string{"file"}, Data: "5"})
+
+	msgs, _, _ = s.Replay(match, 0, 0)
+	if len(msgs) != 1 || msgs[0].Data != "5" {
+		t.Fatalf("Unexpected replay - %#v", msgs)
+	}
+
+	// a message that fails to be written isn't kept
+	s.segmentSize, s.size = defaultSegmentSize, 0
+	current := s.current
+	if s.current, err = os.Open(current.Name()); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := s.Append(Message{Command: "publish", Tags: []string{"file"}, Data: "lost"}); err == nil {
+		t.Fatalf("Expected the append to fail!")
+	}
+	current.Close()
+	s.Append(Message{Command: "publish", Tags: []string{"file"}, Data: "6"})
+
+	msgs, _, _ = s.Replay(match, 0, 0)
+	if len(msgs) != 2 || msgs[0].Data != "5" || msgs[1].Data != "6" {
+		t.Fatalf("Unexpected replay - %#v", msgs)
+	}
+}
+
+// TestFileStorageCorrupt tests to ensure a line in the log that can't be read is
+// skipped, rather than losing everything after it
+func TestFileStorageCorrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mist")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := openFileStorage(dir, defaultSegmentSize, 0, 0, false)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	first, _ := s.Append(Message{Command: "publish", Tags: []string{"file"}, Data: "1"})
+	s.Append(Message{Command: "publish", Tags: []string{"file"}, Data: "2"})
+	s.Close()
+
+	path := filepath.Join(dir, segmentName(first.Seq))
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	lines := strings.SplitAfter(string(b), "\n")
+	corrupt := lines[0] + "not a record\n" + strings.Join(lines[1:], "")
+	if err := ioutil.WriteFile(path, []byte(corrupt), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	s, err = openFileStorage(dir, defaultSegmentSize, 0, 0, false)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer s.Close()
+
+	msgs, _, err := s.Replay(func([]string) bool { return true }, 0, 0)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(msgs) != 2 || msgs[0].Data != "1" || msgs[1].Data != "2" {
+		t.Fatalf("Unexpected replay - %#v", msgs)
+	}
+
+	if b, _ = ioutil.ReadFile(path); string(b) != corrupt {
+		t.Fatalf("Expected the segment to be left alone - %q", b)
+	}
+}
+
+// segmentName is the name of the segment starting at seq
+func segmentName(seq uint64) string {
+	return filepath.Base((&fileStorage{}).path(&segment{first: seq}))
+}
@@ -252,3 +252,112 @@ func TestMatchComplex(t *testing.T) {
 	node.Remove([]string{"a", "b"})
 	node.Remove([]string{"c", "d"})
 }
+
+// TestGlob
+func TestGlob(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"app:*", "app:123", true},
+		{"app:*", "app:", true},
+		{"app:*", "service:web", false},
+		{"service:web*", "service:web", true},
+		{"service:web*", "service:web-1", true},
+		{"service:web*", "service:api", false},
+		{"*:stderr", "log:stderr", true},
+		{"log:std???", "log:stdout", true},
+		{"log:std???", "log:stdin", false},
+		{"*a*b", "xxaxxb", true},
+		{"*a*b", "xxaxxbx", false},
+		{"*", "", true},
+		{"a", "a", true},
+	}
+
+	for _, test := range tests {
+		if glob(test.pattern, test.s) != test.match {
+			t.Errorf("Unexpected result matching '%s' against '%s' - expected %t", test.s, test.pattern, test.match)
+		}
+	}
+}
+
+// TestMatchPatterns
+func TestMatchPatterns(t *testing.T) {
+	subs := newPatterns()
+
+	// exact subscriptions still match
+	subs.Add([]string{"a", "b"})
+	if !subs.Match([]string{"b", "a", "c"}) {
+		t.Fatalf("Expected match!")
+	}
+
+	// every pattern needs to match one of the tags
+	subs.Add([]string{"app:*", "service:web*"})
+	if !subs.Match([]string{"log:stderr", "service:web-1", "app:123"}) {
+		t.Fatalf("Expected match!")
+	}
+	if subs.Match([]string{"app:123", "service:api"}) {
+		t.Fatalf("Unexpected match!")
+	}
+
+	// patterns can be mixed with exact tags
+	subs.Add([]string{"logs", "app:*"})
+	if !subs.Match([]string{"logs", "app:1"}) {
+		t.Fatalf("Expected match!")
+	}
+	if subs.Match([]string{"logs", "service:web"}) {
+		t.Fatalf("Unexpected match!")
+	}
+
+	if len(subs.ToSlice()) != 3 {
+		t.Fatalf("Wrong number of subscriptions - Expecting 3 got %d", len(subs.ToSlice()))
+	}
+
+	// removing is order independent
+	subs.Remove([]string{"service:web*", "app:*"})
+	subs.Remove([]string{"app:*", "logs"})
+	if subs.Match([]string{"logs", "app:1"}) {
+		t.Fatalf("Unexpected match!")
+	}
+	if len(subs.ToSlice()) != 1 {
+		t.Fatalf("Wrong number of subscriptions - Expecting 1 got %d", len(subs.ToSlice()))
+	}
+}
+
+// TestMatchExclusions
+func TestMatchExclusions(t *testing.T) {
+	subs := newPatterns()
+
+	subs.Add([]string{"logs", "!debug"})
+	if !subs.Match([]string{"logs", "stderr"}) {
+		t.Fatalf("Expected match!")
+	}
+	if subs.Match([]string{"logs", "debug"}) {
+		t.Fatalf("Unexpected match!")
+	}
+	if subs.Match([]string{"debug"}) {
+		t.Fatalf("Unexpected match!")
+	}
+
+	// exclusions can be globs too
+	subs.Add([]string{"app:*", "!level:debug*"})
+	if !subs.Match([]string{"app:1", "level:info"}) {
+		t.Fatalf("Expected match!")
+	}
+	if subs.Match([]string{"app:1", "level:debug2"}) {
+		t.Fatalf("Unexpected match!")
+	}
+
+	// exclusions are listed...
+	list := flattenSliceToString(subs.ToSlice())
+	if !strings.Contains(list, "!debug") || !strings.Contains(list, "!level:debug*") {
+		t.Fatalf("Missing exclusions - %s", list)
+	}
+
+	// ...and removed like any other tag
+	subs.Remove([]string{"!debug", "logs"})
+	subs.Remove([]string{"!level:debug*", "app:*"})
+	if len(subs.ToSlice()) != 0 {
+		t.Fatalf("Failed to remove exclusions")
+	}
+}
@@ -1,6 +1,9 @@
 package mist
 
-import "sort"
+import (
+	"sort"
+	"strings"
+)
 
 type (
 	subscriptions interface {
@@ -162,3 +165,151 @@ func (node *Node) ToSlice() (list [][]string) {
 
 	return
 }
+
+type (
+
+	// patterns is a set of subscriptions that allows glob patterns in tags ('*'
+	// matches any run of characters and '?' any single character) and exclusions
+	// ('!' followed by a tag or glob that must not be matched). Subscriptions
+	// without any patterns are kept in a Node so exact matching stays fast; the
+	// rest are matched one by one.
+	patterns struct {
+		exact *Node
+		globs map[string][]string // keyed by the sorted keys joined
+	}
+)
+
+func newPatterns() *patterns {
+	return &patterns{
+		exact: newNode(),
+		globs: map[string][]string{},
+	}
+}
+
+// Add adds keys as either an exact or a pattern subscription
+func (p *patterns) Add(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	if !hasPattern(keys) {
+		p.exact.Add(keys)
+		return
+	}
+
+	sort.Strings(keys)
+	p.globs[strings.Join(keys, "\x00")] = keys
+}
+
+// Remove removes keys from either the exact or the pattern subscriptions
+func (p *patterns) Remove(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	if !hasPattern(keys) {
+		p.exact.Remove(keys)
+		return
+	}
+
+	sort.Strings(keys)
+	delete(p.globs, strings.Join(keys, "\x00"))
+}
+
+// Match looks for an exact match first, and then checks each pattern
+// subscription; a pattern subscription matches when every one of its keys
+// matches at least one of keys, and none of its exclusions match any of keys
+func (p *patterns) Match(keys []string) bool {
+	if p.exact.Match(keys) {
+		return true
+	}
+
+	for _, glob := range p.globs {
+		if matchAll(glob, keys) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ToSlice returns both the exact and pattern subscriptions
+func (p *patterns) ToSlice() (list [][]string) {
+	list = p.exact.ToSlice()
+	for _, glob := range p.globs {
+		list = append(list, append([]string(nil), glob...))
+	}
+
+	return
+}
+
+// hasPattern checks to see if any of keys is a glob or an exclusion
+func hasPattern(keys []string) bool {
+	for _, key := range keys {
+		if strings.ContainsAny(key, "*?") || strings.HasPrefix(key, "!") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchAll checks to see if every one of globs matches at least one of keys,
+// and that every exclusion ("!" + glob) matches none of keys
+func matchAll(globs, keys []string) bool {
+	for _, pattern := range globs {
+		exclude := strings.HasPrefix(pattern, "!")
+		if exclude {
+			pattern = pattern[1:]
+		}
+
+		matched := false
+		for _, key := range keys {
+			if glob(pattern, key) {
+				matched = true
+				break
+			}
+		}
+
+		if matched == exclude {
+			return false
+		}
+	}
+
+	return true
+}
+
+// glob matches s against pattern, where '*' matches any run of characters
+// (including none) and '?' matches any single character
+func glob(pattern, s string) bool {
+	p, i := 0, 0
+	star, mark := -1, 0 // the last '*' seen and where in s it started matching
+
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+
+		case p < len(pattern) && pattern[p] == '*':
+			star, mark = p, i
+			p++
+
+		// backtrack, letting the last '*' match one more character
+		case star != -1:
+			p = star + 1
+			mark++
+			i = mark
+
+		default:
+			return false
+		}
+	}
+
+	// any trailing '*'s match nothing
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+
+	return p == len(pattern)
+}
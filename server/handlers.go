@@ -1,25 +1,117 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
+	"github.com/nanopack/mist/auth"
 	"github.com/nanopack/mist/core"
 )
 
+var (
+	// ErrBadToken is returned when a client authenticates with a token that isn't
+	// the server token and isn't registered with the authenticator
+	ErrBadToken = fmt.Errorf("Token given doesn't match any authorized token")
+
+	// ErrSlow is sent to a client right before it's disconnected for falling too
+	// far behind (with the "disconnect" overflow policy)
+	ErrSlow = fmt.Errorf("Disconnected - too far behind on messages")
+)
+
 // GenerateHandlers ...
 func GenerateHandlers() map[string]mist.HandleFunc {
+
+	// each connection gets its own handlers, so they keep track of what it's
+	// using (unless it has a token to share with; see limiter)
+	return generateHandlers(newLimiter())
+}
+
+// generateHandlers creates handlers that count what's used against a limiter
+func generateHandlers(limits *limiter) map[string]mist.HandleFunc {
 	return map[string]mist.HandleFunc{
-		"auth":        handleAuth,
-		"ping":        handlePing,
-		"subscribe":   handleSubscribe,
-		"unsubscribe": handleUnsubscribe,
-		"publish":     handlePublish,
-		// "publishAfter":     handlePublishAfter,
-		"list":    handleList,
-		"listall": handleListAll, // listall related
-		"who":     handleWho,     // who related
+		"auth":         handleAuth,
+		"ping":         handlePing,
+		"subscribe":    limitSubscriptions(limits, handleSubscribe),
+		"overflow":     handleOverflow,
+		"ack":          handleAck,
+		"unsubscribe":  handleUnsubscribe,
+		"publish":      limitRate(limits, "", handlePublish),
+		"request":      limitRate(limits, "reply", handleRequestMessage),
+		"reply":        handleReply,
+		"publishAfter": limitRate(limits, "publishAfter", handlePublishAfter),
+		"cancel":       handleCancel,
+		"schedule":     handleSchedule,
+		"schedules":    handleSchedules,
+		"unschedule":   handleUnschedule,
+		"list":         handleList,
+		"listall":      handleListAll, // listall related
+		"who":          handleWho,     // who related
+	}
+}
+
+// authenticate checks the token a client connected with; the server token
+// unlocks the auth commands ("admin" mode) while a token registered with the
+// authenticator only allows the tags granted to it (see authorize)
+func authenticate(proxy *mist.Proxy, token string, handlers map[string]mist.HandleFunc) error {
+
+	// without an authenticator everything is allowed
+	if !auth.IsConfigured() {
+		return nil
+	}
+
+	switch {
+
+	// add auth commands ("admin" mode)
+	case token == authtoken:
+		for k, v := range auth.GenerateHandlers() {
+			handlers[k] = v
+		}
+
+	// any other token needs to be registered with the authenticator
+	case token == "" || auth.Authorize(token, nil) != nil:
+		return ErrBadToken
+	}
+
+	// establish that the connection has already authenticated
+	proxy.Token = token
+	proxy.Authenticated = true
+
+	return nil
+}
+
+// authorize checks to see if a proxy is allowed to subscribe/publish to tags;
+// connections using the server token are allowed everything, all others need
+// the tags granted to their token
+func authorize(proxy *mist.Proxy, tags []string) error {
+	if isAdmin(proxy) {
+		return nil
+	}
+
+	// a proxy that never authenticated has no grants
+	if !proxy.Authenticated {
+		return auth.ErrUnauthorized
 	}
+
+	return auth.Authorize(proxy.Token, tags)
+}
+
+// isAdmin checks to see if a proxy is using the server token ("admin" mode);
+// without an authenticator everyone is
+func isAdmin(proxy *mist.Proxy) bool {
+	return !auth.IsConfigured() || (proxy.Authenticated && proxy.Token == authtoken)
+}
+
+// includedTags removes any exclusions ("!tag") from tags; excluding a tag only
+// narrows a subscription so there's no need for it to be granted
+func includedTags(tags []string) (included []string) {
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, "!") {
+			included = append(included, tag)
+		}
+	}
+	return
 }
 
 // handleAuth only exists to avoid getting the message "Unknown command" when
@@ -37,30 +129,164 @@ func handlePing(proxy *mist.Proxy, msg mist.Message) error {
 
 // handleSubscribe
 func handleSubscribe(proxy *mist.Proxy, msg mist.Message) error {
-	proxy.Subscribe(msg.Tags)
+	// a subscription of only exclusions matches every message without them, so it
+	// needs every tag; only admins have that
+	included := includedTags(msg.Tags)
+	if len(included) == 0 && len(msg.Tags) > 0 && !isAdmin(proxy) {
+		return auth.ErrUnauthorized
+	}
+
+	if err := authorize(proxy, included); err != nil {
+		return err
+	}
+
+	if msg.Filter != nil {
+		if msg.Group != "" || msg.Replay > 0 || msg.Since > 0 {
+			return fmt.Errorf("Filtered subscriptions can't be in a group or replay messages")
+		}
+		return proxy.SubscribeFilter(msg.Tags, *msg.Filter, msg.Ack)
+	}
+
+	if msg.Group != "" {
+		return proxy.SubscribeGroup(msg.Group, msg.Tags, msg.Ack)
+	}
+
+	if msg.Ack {
+		return proxy.SubscribeAck(msg.Tags, msg.Replay, msg.Since)
+	}
+
+	return proxy.SubscribeReplay(msg.Tags, msg.Replay, msg.Since)
+}
+
+// handleAck acks the message (by id) sent for an ack subscription, so it isn't
+// sent again
+func handleAck(proxy *mist.Proxy, msg mist.Message) error {
+	return proxy.Ack(msg.Data)
+}
+
+// handleOverflow sets what happens to messages published to the connection once
+// it falls too far behind (drop-newest, drop-oldest or disconnect)
+func handleOverflow(proxy *mist.Proxy, msg mist.Message) error {
+	policy, err := mist.ParseOverflow(msg.Data)
+	if err != nil {
+		return err
+	}
+
+	proxy.SetOverflow(policy)
 	return nil
 }
 
 // handleUnsubscribe
 func handleUnsubscribe(proxy *mist.Proxy, msg mist.Message) error {
-	proxy.Unsubscribe(msg.Tags)
+	proxy.UnsubscribeGroup(msg.Group, msg.Tags)
 	return nil
 }
 
 // handlePublish
 func handlePublish(proxy *mist.Proxy, msg mist.Message) error {
-	proxy.Publish(msg.Tags, msg.Data)
+	if err := authorize(proxy, msg.Tags); err != nil {
+		return err
+	}
+
+	return proxy.PublishMessage(msg)
+}
+
+// handleRequestMessage sends a request to one subscriber of its tags; any error
+// (including not being allowed the tags) comes back as the reply, so the client
+// can match it to the request by correlation
+func handleRequestMessage(proxy *mist.Proxy, msg mist.Message) error {
+	err := authorize(proxy, msg.Tags)
+	if err == nil {
+		err = proxy.Request(msg.Tags, msg.Data, msg.Correlation, time.Duration(msg.Timeout)*time.Millisecond)
+	}
+
+	if err != nil {
+		proxy.Pipe <- mist.Message{Command: "reply", Tags: msg.Tags, Correlation: msg.Correlation, Error: err.Error()}
+	}
+
+	return nil
+}
+
+// handleReply replies to a request (by the correlation it was received with)
+func handleReply(proxy *mist.Proxy, msg mist.Message) error {
+	return proxy.Reply(msg.Correlation, msg.Data)
+}
+
+// handlePublishAfter publishes a message after a delay (in milliseconds), or at
+// a time, replying with the id it can be cancelled with. Like requests, any error
+// comes back with the correlation the client sent.
+func handlePublishAfter(proxy *mist.Proxy, msg mist.Message) error {
+	at := time.Now().Add(time.Duration(msg.Delay) * time.Millisecond)
+	if msg.When != nil {
+		at = *msg.When
+	}
+
+	var id string
+	err := authorize(proxy, msg.Tags)
+	if err == nil {
+		id, err = proxy.PublishAt(msg, at)
+	}
+
+	if err != nil {
+		proxy.Pipe <- mist.Message{Command: "publishAfter", Tags: msg.Tags, Correlation: msg.Correlation, Error: err.Error()}
+		return nil
+	}
+
+	proxy.Pipe <- mist.Message{Command: "publishAfter", Tags: msg.Tags, Data: id, Correlation: msg.Correlation}
 	return nil
 }
 
-// handlePublishAfter - how do we get the [delay] here?
-// func handlePublishAfter(proxy *mist.Proxy, msg mist.Message) error {
-// 	proxy.PublishAfter(msg.Tags, msg.Data, ???)
-// 	go func() {
-// 		proxy.Pipe <- mist.Message{Command: "publish after", Tags: msg.Tags, Data: "success"}
-// 	}()
-// 	return nil
-// }
+// handleCancel cancels a publishAfter (by the id it replied with) that hasn't
+// been published yet; only the token it was published with (or the server token)
+// can cancel it
+func handleCancel(proxy *mist.Proxy, msg mist.Message) error {
+	if isAdmin(proxy) {
+		return mist.Cancel(msg.Data)
+	}
+
+	return proxy.Cancel(msg.Data)
+}
+
+// handleSchedule publishes a message on a schedule (a cron expression or
+// interval), replying with the id it can be removed with; only admins can
+// schedule messages
+func handleSchedule(proxy *mist.Proxy, msg mist.Message) error {
+	if !isAdmin(proxy) {
+		return auth.ErrUnauthorized
+	}
+
+	s, err := mist.AddSchedule(mist.Schedule{Spec: msg.Schedule, Tags: msg.Tags, Data: msg.Data, Headers: msg.Headers})
+	if err != nil {
+		return err
+	}
+
+	proxy.Pipe <- mist.Message{Command: "schedule", Tags: msg.Tags, Data: s.ID, Schedule: s.Spec}
+	return nil
+}
+
+// handleSchedules lists the schedules, as JSON
+func handleSchedules(proxy *mist.Proxy, msg mist.Message) error {
+	if !isAdmin(proxy) {
+		return auth.ErrUnauthorized
+	}
+
+	b, err := json.Marshal(mist.Schedules())
+	if err != nil {
+		return err
+	}
+
+	proxy.Pipe <- mist.Message{Command: "schedules", Data: string(b), Raw: true}
+	return nil
+}
+
+// handleUnschedule removes a schedule (by id)
+func handleUnschedule(proxy *mist.Proxy, msg mist.Message) error {
+	if !isAdmin(proxy) {
+		return auth.ErrUnauthorized
+	}
+
+	return mist.RemoveSchedule(msg.Data)
+}
 
 // handleList
 func handleList(proxy *mist.Proxy, msg mist.Message) error {
@@ -82,7 +308,7 @@ func handleListAll(proxy *mist.Proxy, msg mist.Message) error {
 // handleWho - who related
 func handleWho(proxy *mist.Proxy, msg mist.Message) error {
 	who, max := mist.Who()
-	subscribers := fmt.Sprintf("Lifetime  connections: %d\nSubscribers connected: %d", max, who)
+	subscribers := fmt.Sprintf("Lifetime  connections: %d\nSubscribers connected: %d\nMessages dropped: %d\nDropped (this connection): %d\nMax message size (this connection): %d", max, who, mist.Dropped(), proxy.Dropped(), proxy.MaxMessageSize)
 	proxy.Pipe <- mist.Message{Command: "who", Tags: msg.Tags, Data: subscribers}
 	return nil
 }
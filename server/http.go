@@ -1,16 +1,32 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/pat"
 	"github.com/jcelliott/lumber"
+
+	"github.com/nanopack/mist/auth"
+	"github.com/nanopack/mist/core"
 )
 
 var (
 	// Router ...
 	Router = pat.New()
+
+	// the routes are registered on Router once, however many listeners use it
+	routesOnce sync.Once
+
+	// HeartbeatInterval is how often an idle event stream is sent a heartbeat
+	HeartbeatInterval = 15 * time.Second
 )
 
 // init adds http/https as available mist server types
@@ -28,24 +44,49 @@ func StartHTTP(uri string, errChan chan<- error) {
 
 // StartHTTPS starts a mist server listening over HTTPS
 func StartHTTPS(uri string, errChan chan<- error) {
-	errChan <- ErrNotImplemented
+	if err := newHTTPS(uri); err != nil {
+		errChan <- fmt.Errorf("Unable to start mist https listener - %s", err.Error())
+	}
 }
 
 func newHTTP(address string) error {
+	max, err := maxMessageSize(address)
+	if err != nil {
+		return err
+	}
+
 	lumber.Info("HTTP server listening at '%s'...\n", address)
 
 	// blocking...
-	return http.ListenAndServe(address, routes())
+	return http.ListenAndServe(address, limitBody(max, routes()))
 }
 
-// routes registers all api routes with the router
+func newHTTPS(address string) error {
+	max, err := maxMessageSize(address)
+	if err != nil {
+		return err
+	}
+
+	lumber.Info("HTTPS server listening at '%s'...\n", address)
+
+	// blocking...
+	return listenAndServeTLS(address, limitBody(max, routes()))
+}
+
+// routes registers all api routes with the router, the first time it's called
 func routes() *pat.Router {
-	Router.Get("/ping", func(rw http.ResponseWriter, req *http.Request) {
-		rw.Write([]byte("pong\n"))
+	routesOnce.Do(func() {
+		Router.Get("/ping", func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte("pong\n"))
+		})
+		Router.Post("/publish", handleRequest(publish))
+		Router.Post("/publishAfter", handleRequest(publishAfter))
+		Router.Post("/cancel", handleRequest(cancel))
+		Router.Get("/list", handleRequest(list))
+		Router.Get("/who", handleRequest(who))
+		Router.Get("/subscribe/events", handleRequest(subscribeEvents)) // needs to be before /subscribe (routes match prefixes)
+		Router.Get("/subscribe", handleRequest(subscribe))
 	})
-	// Router.Get("/list", handleRequest(list))
-	// Router.Get("/subscribe", handleRequest(subscribe))
-	// Router.Get("/unsubscribe", handleRequest(unsubscribe))
 
 	return Router
 }
@@ -54,6 +95,314 @@ func routes() *pat.Router {
 // debug output
 func handleRequest(fn func(http.ResponseWriter, *http.Request)) http.HandlerFunc {
 	return func(rw http.ResponseWriter, req *http.Request) {
+		lumber.Trace("HTTP %s %s", req.Method, req.URL.Path)
 		fn(rw, req)
 	}
 }
+
+// publish publishes the mist message in the body of the request
+func publish(rw http.ResponseWriter, req *http.Request) {
+	msg, ok := decodeMessage(rw, req, "publish")
+	if !ok {
+		return
+	}
+
+	runCommand(rw, req, msg)
+}
+
+// publishAfter publishes the mist message in the body of the request after its
+// delay (or at its time), replying with the id it can be cancelled with
+func publishAfter(rw http.ResponseWriter, req *http.Request) {
+	msg, ok := decodeMessage(rw, req, "publishAfter")
+	if !ok {
+		return
+	}
+
+	runCommand(rw, req, msg)
+}
+
+// cancel cancels the publishAfter with the id in the body of the request
+func cancel(rw http.ResponseWriter, req *http.Request) {
+	msg, ok := decodeMessage(rw, req, "cancel")
+	if !ok {
+		return
+	}
+
+	runCommand(rw, req, msg)
+}
+
+// decodeMessage decodes the mist message in the body of a request, writing
+// back an error if it can't be
+func decodeMessage(rw http.ResponseWriter, req *http.Request, command string) (mist.Message, bool) {
+	msg := mist.Message{}
+	if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+		status := http.StatusBadRequest
+		if err == ErrTooLarge {
+			status = http.StatusRequestEntityTooLarge
+		}
+		writeJSON(rw, status, mist.Message{Command: command, Error: fmt.Sprintf("Failed to decode message - %s", err.Error())})
+		return msg, false
+	}
+	msg.Command = command
+
+	return msg, true
+}
+
+// list lists all the tags subscribers are subscribed to; an http request has
+// no subscriptions of its own so this is the same as the 'listall' command
+func list(rw http.ResponseWriter, req *http.Request) {
+	runCommand(rw, req, mist.Message{Command: "listall"})
+}
+
+// who lists connection stats
+func who(rw http.ResponseWriter, req *http.Request) {
+	runCommand(rw, req, mist.Message{Command: "who"})
+}
+
+// subscribe subscribes to the (comma delimited) tags in the query and then
+// streams each message as a line of JSON until the client disconnects; retained
+// messages can be replayed first with ?replay=<count> and/or ?since=<seq>
+func subscribe(rw http.ResponseWriter, req *http.Request) {
+	stream(rw, req, "application/json", func(w io.Writer, msg mist.Message) error {
+		return json.NewEncoder(w).Encode(msg)
+	}, nil)
+}
+
+// subscribeEvents subscribes to the (comma delimited) tags in the query and then
+// streams each message as a Server-Sent Event, with periodic heartbeat comments
+// to keep the connection (and any proxies along the way) from timing out. Each
+// event's id is the message's seq, so a reconnecting client's Last-Event-ID
+// replays whatever it missed (if history is enabled).
+func subscribeEvents(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("X-Accel-Buffering", "no") // keep nginx from buffering the stream
+
+	stream(rw, req, "text/event-stream", func(w io.Writer, msg mist.Message) error {
+		b, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+
+		// encoded JSON never contains a newline, so it fits in a single data field
+		_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", msg.Seq, b)
+		return err
+	}, func(w io.Writer) error {
+		_, err := io.WriteString(w, ": heartbeat\n\n")
+		return err
+	})
+}
+
+// stream subscribes a new proxy to the tags in the query of a request and then
+// writes each message from the proxy until the client disconnects; if heartbeat
+// is provided it's written whenever the stream has been idle for a while
+func stream(rw http.ResponseWriter, req *http.Request, contentType string, write func(io.Writer, mist.Message) error, heartbeat func(io.Writer) error) {
+	proxy, handlers, ok := newRequestProxy(rw, req, "subscribe")
+	if !ok {
+		return
+	}
+	defer proxy.Close()
+
+	tags := requestTags(req)
+	if len(tags) == 0 {
+		writeJSON(rw, http.StatusBadRequest, mist.Message{Command: "subscribe", Error: "Missing tags"})
+		return
+	}
+
+	replay, since, err := requestReplay(req)
+	if err != nil {
+		writeJSON(rw, http.StatusBadRequest, mist.Message{Command: "subscribe", Error: err.Error()})
+		return
+	}
+
+	// replayed messages are sent over the proxy's pipe while subscribing, so the
+	// handler is run alongside holding on to them until it's done
+	errs := make(chan error, 1)
+	go func() {
+		errs <- handlers["subscribe"](proxy, mist.Message{Command: "subscribe", Tags: tags, Replay: replay, Since: since})
+	}()
+
+	var pending []mist.Message
+	for subscribed := false; !subscribed; {
+		select {
+		case msg, ok := <-proxy.Pipe:
+			if !ok {
+				return
+			}
+			pending = append(pending, msg)
+
+		case err := <-errs:
+			if err != nil {
+				writeError(rw, "subscribe", err)
+				return
+			}
+			subscribed = true
+		}
+	}
+
+	// the response needs to be flushed after each message for it to be a stream
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		writeJSON(rw, http.StatusInternalServerError, mist.Message{Command: "subscribe", Error: "Streaming unsupported"})
+		return
+	}
+
+	rw.Header().Set("Content-Type", contentType)
+	rw.WriteHeader(http.StatusOK)
+
+	for _, msg := range pending {
+		if err := write(rw, msg); err != nil {
+			lumber.Debug("HTTP Failed to write message - %s", err.Error())
+			return
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case msg, ok := <-proxy.Pipe:
+			if !ok {
+				return
+			}
+
+			// failing to write is probably because the client is gone
+			if err := write(rw, msg); err != nil {
+				lumber.Debug("HTTP Failed to write message - %s", err.Error())
+				return
+			}
+			flusher.Flush()
+
+		case <-ticker.C:
+			if heartbeat == nil {
+				continue
+			}
+
+			if err := heartbeat(rw); err != nil {
+				lumber.Debug("HTTP Failed to write heartbeat - %s", err.Error())
+				return
+			}
+			flusher.Flush()
+
+		// the client fell too far behind
+		case <-proxy.Slow():
+			lumber.Debug("HTTP client too far behind, disconnecting")
+			write(rw, mist.Message{Command: "publish", Error: ErrSlow.Error()})
+			return
+
+		// the client disconnected
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// runCommand runs a single command for a request through the same handlers (and
+// token checks) as the other listeners, writing back the reply
+func runCommand(rw http.ResponseWriter, req *http.Request, msg mist.Message) {
+	proxy, handlers, ok := newRequestProxy(rw, req, msg.Command)
+	if !ok {
+		return
+	}
+	defer proxy.Close()
+
+	// commands that reply do so over the proxy's pipe, which blocks until read, so
+	// the handler is run alongside waiting for a reply
+	errs := make(chan error, 1)
+	go func() {
+		errs <- handlers[msg.Command](proxy, msg)
+	}()
+
+	select {
+	case reply := <-proxy.Pipe:
+		writeJSON(rw, http.StatusOK, reply)
+	case err := <-errs:
+		if err != nil {
+			writeError(rw, msg.Command, err)
+			return
+		}
+		writeJSON(rw, http.StatusOK, mist.Message{Command: msg.Command, Tags: msg.Tags, Data: "success"})
+	}
+}
+
+// newRequestProxy creates a proxy for a request, authenticating it with the
+// token provided with the request (if an authenticator is configured)
+func newRequestProxy(rw http.ResponseWriter, req *http.Request, command string) (*mist.Proxy, map[string]mist.HandleFunc, bool) {
+	proxy := mist.NewProxy()
+
+	// a request is its own connection, so requests from the same address share
+	// their limits (or, with a token, those of the token)
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	handlers := generateHandlers(sharedLimiter("address:" + host))
+
+	if body, ok := req.Body.(*limitedReader); ok {
+		proxy.MaxMessageSize = body.limit
+	}
+
+	if err := authenticate(proxy, requestToken(req), handlers); err != nil {
+		proxy.Close()
+		writeJSON(rw, http.StatusUnauthorized, mist.Message{Command: command, Error: err.Error()})
+		return nil, nil, false
+	}
+
+	return proxy, handlers, true
+}
+
+// requestTags gets the comma delimited list of tags from a request's query
+func requestTags(req *http.Request) (tags []string) {
+	for _, tag := range strings.Split(req.FormValue("tags"), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return
+}
+
+// requestReplay gets how many retained messages to replay (?replay=) and the seq
+// to replay them after (?since=, or the Last-Event-ID of a reconnecting event
+// stream) from a request
+func requestReplay(req *http.Request) (replay int, since uint64, err error) {
+	if value := req.FormValue("replay"); value != "" {
+		if replay, err = strconv.Atoi(value); err != nil {
+			return 0, 0, fmt.Errorf("Invalid replay '%s'", value)
+		}
+	}
+
+	value := req.FormValue("since")
+	if value == "" {
+		value = req.Header.Get("Last-Event-ID")
+	}
+
+	if value != "" {
+		if since, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return 0, 0, fmt.Errorf("Invalid since '%s'", value)
+		}
+	}
+
+	return
+}
+
+// writeError writes the error from a command, as forbidden if the token isn't
+// allowed the tags
+func writeError(rw http.ResponseWriter, command string, err error) {
+	status := http.StatusBadRequest
+	if err == auth.ErrUnauthorized {
+		status = http.StatusForbidden
+	}
+
+	writeJSON(rw, status, mist.Message{Command: command, Error: err.Error()})
+}
+
+// writeJSON writes a message as the JSON response to a request
+func writeJSON(rw http.ResponseWriter, status int, msg mist.Message) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+
+	if err := json.NewEncoder(rw).Encode(msg); err != nil {
+		lumber.Debug("HTTP Failed to write response - %s", err.Error())
+	}
+}
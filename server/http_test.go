@@ -1,11 +1,22 @@
 package server_test
 
 import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/nanopack/mist/auth"
+	"github.com/nanopack/mist/core"
+	"github.com/nanopack/mist/internal/testutil"
 	"github.com/nanopack/mist/server"
 )
 
@@ -23,3 +34,183 @@ func TestHTTPStart(t *testing.T) {
 	}()
 	<-time.After(time.Second)
 }
+
+// TestHTTPAPI tests publishing to a subscription stream, and the list/who
+// commands over HTTP
+func TestHTTPAPI(t *testing.T) {
+	addr := "http://127.0.0.1:8080"
+
+	// a subscription needs tags
+	res, err := http.Get(addr + "/subscribe")
+	if err != nil {
+		t.Fatalf("Unexpected error - %s", err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected bad request - %d", res.StatusCode)
+	}
+
+	// start a subscription stream
+	stream, err := http.Get(addr + "/subscribe?tags=a,b")
+	if err != nil {
+		t.Fatalf("Unexpected error - %s", err.Error())
+	}
+	defer stream.Body.Close()
+
+	// the subscription should show up in the list
+	if msg := httpCommand("GET", addr+"/list", "", t); msg.Command != "listall" || !strings.Contains(msg.Data, "a") {
+		t.Fatalf("Unexpected list - %#v", msg)
+	}
+	if msg := httpCommand("GET", addr+"/who", "", t); msg.Command != "who" || msg.Data == "" {
+		t.Fatalf("Unexpected who - %#v", msg)
+	}
+
+	// publish a message the subscription should get
+	if msg := httpCommand("POST", addr+"/publish", `{"tags":["a","b"],"data":"hello"}`, t); msg.Error != "" {
+		t.Fatalf("Unexpected error - %s", msg.Error)
+	}
+
+	messages := make(chan mist.Message)
+	go func() {
+		msg := mist.Message{}
+		if err := json.NewDecoder(bufio.NewReader(stream.Body)).Decode(&msg); err == nil {
+			messages <- msg
+		}
+	}()
+
+	select {
+	case msg := <-messages:
+		if msg.Data != "hello" {
+			t.Fatalf("Unexpected data - %#v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting message, received none!")
+	}
+
+	// publishing without tags is an error
+	if msg := httpCommand("POST", addr+"/publish", `{"data":"hello"}`, t); msg.Error == "" {
+		t.Fatalf("Expected error publishing without tags")
+	}
+}
+
+// TestHTTPEvents tests subscribing over Server-Sent Events
+func TestHTTPEvents(t *testing.T) {
+	addr := "http://127.0.0.1:8080"
+	server.HeartbeatInterval = 100 * time.Millisecond
+
+	stream, err := http.Get(addr + "/subscribe/events?tags=events")
+	if err != nil {
+		t.Fatalf("Unexpected error - %s", err.Error())
+	}
+	defer stream.Body.Close()
+
+	if contentType := stream.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("Unexpected content type - %s", contentType)
+	}
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(stream.Body)
+		for scanner.Scan() {
+			if scanner.Text() != "" {
+				lines <- scanner.Text()
+			}
+		}
+	}()
+
+	// an idle stream should get a heartbeat
+	select {
+	case line := <-lines:
+		if line != ": heartbeat" {
+			t.Fatalf("Expected heartbeat - %s", line)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expecting heartbeat, received none!")
+	}
+
+	server.HeartbeatInterval = 15 * time.Second
+	httpCommand("POST", addr+"/publish", `{"tags":["events"],"data":"hello"}`, t)
+
+	// skip any heartbeats that were already on their way
+	var id string
+	for {
+		select {
+		case line := <-lines:
+			if line == ": heartbeat" {
+				continue
+			}
+
+			// each event's id is the seq of its message
+			if strings.HasPrefix(line, "id: ") {
+				id = strings.TrimPrefix(line, "id: ")
+				continue
+			}
+
+			msg := mist.Message{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &msg); err != nil {
+				t.Fatalf("Failed to decode event '%s' - %s", line, err.Error())
+			}
+			if msg.Data != "hello" {
+				t.Fatalf("Unexpected data - %#v", msg)
+			}
+			if id != fmt.Sprint(msg.Seq) {
+				t.Fatalf("Unexpected event id '%s' - %#v", id, msg)
+			}
+			return
+		case <-time.After(time.Second):
+			t.Fatalf("Expecting event, received none!")
+		}
+	}
+}
+
+// TestHTTPSStart tests to ensure a server will start with a configured
+// certificate, and serve over it
+func TestHTTPSStart(t *testing.T) {
+	fmt.Println("Starting HTTPS test...")
+
+	// ensure authentication is disabled
+	auth.Start("")
+
+	cert, key := testutil.WriteCert(t)
+	defer os.RemoveAll(filepath.Dir(cert))
+
+	go server.Start([]string{fmt.Sprintf("https://127.0.0.1:8443?cert=%s&key=%s", cert, key)}, "")
+	<-time.After(time.Second)
+
+	// only trust the configured certificate
+	pem, err := ioutil.ReadFile(cert)
+	if err != nil {
+		t.Fatalf("Unexpected error - %s", err.Error())
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pem)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+
+	res, err := client.Get("https://127.0.0.1:8443/ping")
+	if err != nil {
+		t.Fatalf("Unexpected error - %s", err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status - %d", res.StatusCode)
+	}
+}
+
+// httpCommand makes a request to the HTTP api, decoding the reply
+func httpCommand(method, url, body string, t *testing.T) (msg mist.Message) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Unexpected error - %s", err.Error())
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error - %s", err.Error())
+	}
+	defer res.Body.Close()
+
+	if err := json.NewDecoder(res.Body).Decode(&msg); err != nil {
+		t.Fatalf("Failed to decode reply - %s", err.Error())
+	}
+	return
+}
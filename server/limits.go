@@ -0,0 +1,281 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nanopack/mist/core"
+)
+
+var (
+	// DefaultLimits are what every connection is allowed, unless its token has
+	// limits of its own (see TokenLimits)
+	DefaultLimits Limits
+
+	// TokenLimits override DefaultLimits for connections authenticated with a
+	// token; only the limits that are set (not 0) are overridden
+	TokenLimits = map[string]Limits{}
+
+	// ErrTooManySubscriptions is returned when subscribing past a connection's limit
+	ErrTooManySubscriptions = fmt.Errorf("Too many subscriptions")
+
+	// ErrTooManyTags is returned when subscribing to more tags than allowed at once
+	ErrTooManyTags = fmt.Errorf("Too many tags in subscription")
+
+	// ErrRateLimited is returned when publishing faster than allowed
+	ErrRateLimited = fmt.Errorf("Publishing too fast")
+
+	// connections using the same token (and http requests from the same address)
+	// share what's counted against their limits, so opening more of them doesn't
+	// get around the limits (see sharedLimiter)
+	shared    = map[string]*limiter{}
+	sharedTex sync.Mutex
+	swept     time.Time // when idle limiters were last forgotten
+
+	// limiterIdle is how long a shared limiter without subscriptions is kept
+	// after it was last used
+	limiterIdle = time.Minute
+)
+
+type (
+	// Limits are what a connection is allowed; 0 (or less) is unlimited. In
+	// TokenLimits 0 keeps the default, and anything less is unlimited.
+	Limits struct {
+		Subscriptions int     `json:"subscriptions" mapstructure:"subscriptions"` // how many subscriptions a connection can have
+		Tags          int     `json:"tags" mapstructure:"tags"`                   // how many tags a subscription can have
+		PublishRate   float64 `json:"publish-rate" mapstructure:"publish-rate"`   // how many messages a connection can publish a second
+		PublishBurst  int     `json:"publish-burst" mapstructure:"publish-burst"` // how many messages can be published at once before the rate applies
+	}
+
+	// bucket is a token bucket limiting how fast a connection publishes
+	bucket struct {
+		sync.Mutex
+
+		tokens float64
+		last   time.Time
+	}
+
+	// limiter is what's counted against the limits of a connection, or of every
+	// connection sharing it
+	limiter struct {
+		sync.Mutex
+
+		rate    bucket
+		proxies map[*mist.Proxy]bool // the proxies subscribing with it, whose subscriptions count
+		used    time.Time            // when it was last used, so idle shared limiters are forgotten
+	}
+)
+
+// limitsFor returns the limits for a connection authenticated with token
+func limitsFor(token string) Limits {
+	limits := DefaultLimits
+
+	override, ok := TokenLimits[token]
+	if token == "" || !ok {
+		return limits
+	}
+
+	if override.Subscriptions != 0 {
+		limits.Subscriptions = override.Subscriptions
+	}
+	if override.Tags != 0 {
+		limits.Tags = override.Tags
+	}
+	if override.PublishRate != 0 {
+		limits.PublishRate = override.PublishRate
+	}
+	if override.PublishBurst != 0 {
+		limits.PublishBurst = override.PublishBurst
+	}
+
+	return limits
+}
+
+// newLimiter creates a limiter for a single connection
+func newLimiter() *limiter {
+	return &limiter{proxies: map[*mist.Proxy]bool{}}
+}
+
+// sharedLimiter returns the limiter shared by everything using key, creating it
+// if needed; limiters that have been idle for a while are forgotten
+func sharedLimiter(key string) *limiter {
+	sharedTex.Lock()
+	defer sharedTex.Unlock()
+
+	now := time.Now()
+	if now.Sub(swept) > limiterIdle {
+		for k, l := range shared {
+			if l.idle(now) {
+				delete(shared, k)
+			}
+		}
+		swept = now
+	}
+
+	l, ok := shared[key]
+	if !ok {
+		l = newLimiter()
+		shared[key] = l
+	}
+
+	l.Lock()
+	l.used = now
+	l.Unlock()
+
+	return l
+}
+
+// forProxy returns the limiter a proxy is counted against; proxies with a token
+// share the token's, anything else uses l
+func (l *limiter) forProxy(proxy *mist.Proxy) *limiter {
+	if proxy.Token == "" {
+		return l
+	}
+
+	return sharedLimiter("token:" + proxy.Token)
+}
+
+// idle checks to see if a limiter has no subscriptions and hasn't been used
+// since limiterIdle before now
+func (l *limiter) idle(now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	l.prune()
+
+	return len(l.proxies) == 0 && now.Sub(l.used) > limiterIdle
+}
+
+// prune forgets the proxies that have been closed. This has to be called with
+// the limiter locked.
+func (l *limiter) prune() {
+	for proxy := range l.proxies {
+		select {
+		case <-proxy.Done():
+			delete(l.proxies, proxy)
+		default:
+		}
+	}
+}
+
+// checkSubscription checks to see if a proxy is allowed another subscription
+// to tags; the subscriptions of every proxy using the limiter count
+func (l *limiter) checkSubscription(proxy *mist.Proxy, tags []string) error {
+	limits := limitsFor(proxy.Token)
+
+	if limits.Tags > 0 && len(tags) > limits.Tags {
+		return ErrTooManyTags
+	}
+
+	if limits.Subscriptions <= 0 {
+		return nil
+	}
+
+	// subscribing to tags again doesn't add a subscription
+	for _, subscribed := range proxy.List() {
+		if sameTags(subscribed, tags) {
+			return nil
+		}
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.prune()
+	l.proxies[proxy] = true
+
+	subscriptions := 0
+	for p := range l.proxies {
+		subscriptions += len(p.List())
+	}
+
+	if subscriptions >= limits.Subscriptions {
+		return ErrTooManySubscriptions
+	}
+
+	return nil
+}
+
+// limitSubscriptions only runs a subscribing command if the connection (or
+// those sharing its limits) is allowed another subscription
+func limitSubscriptions(l *limiter, handler mist.HandleFunc) mist.HandleFunc {
+	return func(proxy *mist.Proxy, msg mist.Message) error {
+		if err := l.forProxy(proxy).checkSubscription(proxy, msg.Tags); err != nil {
+			return err
+		}
+
+		return handler(proxy, msg)
+	}
+}
+
+// sameTags checks to see if two sets of tags are the same, in any order
+func sameTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	a, b = append([]string(nil), a...), append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// limitRate only runs a publishing command while the connection's bucket (or
+// the one it shares) has room; commands that reply to a correlation (like
+// requests) get the error the same way, as a [reply] command
+func limitRate(l *limiter, reply string, handler mist.HandleFunc) mist.HandleFunc {
+	return func(proxy *mist.Proxy, msg mist.Message) error {
+		limits := limitsFor(proxy.Token)
+		if l.forProxy(proxy).rate.take(limits.PublishRate, limits.PublishBurst) {
+			return handler(proxy, msg)
+		}
+
+		if reply == "" {
+			return ErrRateLimited
+		}
+
+		proxy.Pipe <- mist.Message{Command: reply, Tags: msg.Tags, Correlation: msg.Correlation, Error: ErrRateLimited.Error()}
+		return nil
+	}
+}
+
+// take takes a token from the bucket if there is one, refilling it at rate
+// tokens a second up to burst (or about a second's worth if burst isn't set)
+func (b *bucket) take(rate float64, burst int) bool {
+	if rate <= 0 {
+		return true
+	}
+
+	size := float64(burst)
+	if burst <= 0 {
+		size = math.Max(1, math.Ceil(rate))
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = size
+	} else {
+		b.tokens = math.Min(size, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
@@ -18,7 +18,22 @@ var (
 	servers    = map[string]handleFunc{}
 	serversTex sync.RWMutex
 
+	// the query options of each started listener (keyed by host)
+	listeners    = map[string]url.Values{}
+	listenersTex sync.RWMutex
+
 	authtoken string // used when determining if auth command handlers should be added
+
+	// CertFile and KeyFile are the certificate used by TLS listeners that aren't
+	// given their own (?cert=&key=); if neither is set a self-signed certificate
+	// is generated
+	CertFile string
+	KeyFile  string
+
+	// CAFile is the CA that tls listeners that aren't given their own (?ca=)
+	// require client certificates to be signed by; no CA means no client
+	// certificates are needed
+	CAFile string
 )
 
 type (
@@ -69,6 +84,11 @@ func Start(uris []string, token string) error {
 			continue
 		}
 
+		// keep the listener's options around for the server to look up
+		listenersTex.Lock()
+		listeners[url.Host] = url.Query()
+		listenersTex.Unlock()
+
 		// attempt to start the server
 		lumber.Info("Starting '%s' server...", url.Scheme)
 		go server(url.Host, errChan)
@@ -94,3 +114,11 @@ func Start(uris []string, token string) error {
 
 	return nil
 }
+
+// option returns an option from the query of the listener started at host
+func option(host, name string) string {
+	listenersTex.RLock()
+	defer listenersTex.RUnlock()
+
+	return listeners[host].Get(name)
+}
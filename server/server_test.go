@@ -1,11 +1,20 @@
 package server_test
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
+
 	"github.com/nanopack/mist/auth"
+	"github.com/nanopack/mist/clients"
+	"github.com/nanopack/mist/core"
+	"github.com/nanopack/mist/internal/testutil"
 	"github.com/nanopack/mist/server"
 )
 
@@ -39,3 +48,327 @@ func TestAuthStart(t *testing.T) {
 	// 	t.Fatalf("Incorrect token!")
 	// }
 }
+
+// TestTagPermissions tests that a connection authenticated with a registered
+// token is only allowed to subscribe/publish to the tags granted to it
+func TestTagPermissions(t *testing.T) {
+	addr := "127.0.0.1:1447"
+
+	// start an authenticator
+	if err := auth.Start("memory://"); err != nil {
+		t.Fatalf("Unexpected error - %s", err.Error())
+	}
+	defer auth.Start("")
+
+	go server.Start([]string{"tcp://" + addr}, "TOKEN")
+	<-time.After(time.Second)
+
+	// register a token using the server token ("admin" mode)
+	admin := dial(addr, t)
+	defer admin.Close()
+	admin.send(mist.Message{Command: "auth", Data: "TOKEN"}, t)
+	admin.send(mist.Message{Command: "register", Tags: []string{"a", "b"}, Data: "user"}, t)
+	admin.send(mist.Message{Command: "ping"}, t)
+	if msg := admin.receive(t); msg.Error != "" {
+		t.Fatalf("Unexpected error - %s", msg.Error)
+	}
+
+	// a token that isn't registered gets disconnected
+	if _, err := clients.New(addr, "nope"); err == nil {
+		t.Fatalf("Expected unregistered token to be disconnected")
+	}
+
+	user := dial(addr, t)
+	defer user.Close()
+	user.send(mist.Message{Command: "auth", Data: "user"}, t)
+
+	// granted tags are allowed...
+	user.send(mist.Message{Command: "subscribe", Tags: []string{"a", "b"}}, t)
+	user.send(mist.Message{Command: "publish", Tags: []string{"a"}, Data: "hi"}, t)
+	user.send(mist.Message{Command: "ping"}, t)
+	if msg := user.receive(t); msg.Command != "ping" {
+		t.Fatalf("Unexpected reply - %#v", msg)
+	}
+
+	// ...tags that weren't granted are not
+	for _, command := range []string{"subscribe", "publish"} {
+		user.send(mist.Message{Command: command, Tags: []string{"a", "c"}, Data: "hi"}, t)
+		if msg := user.receive(t); msg.Command != command || msg.Error == "" {
+			t.Fatalf("Expected '%s' to be denied - %#v", command, msg)
+		}
+	}
+
+	// excluding tags only narrows a subscription to granted tags; a subscription
+	// of only exclusions would match tags that weren't granted
+	user.send(mist.Message{Command: "subscribe", Tags: []string{"a", "!c"}}, t)
+	user.send(mist.Message{Command: "ping"}, t)
+	if msg := user.receive(t); msg.Command != "ping" {
+		t.Fatalf("Unexpected reply - %#v", msg)
+	}
+	user.send(mist.Message{Command: "subscribe", Tags: []string{"!nothing"}}, t)
+	if msg := user.receive(t); msg.Command != "subscribe" || msg.Error != auth.ErrUnauthorized.Error() {
+		t.Fatalf("Expected a subscription of only exclusions to be denied - %#v", msg)
+	}
+	admin.send(mist.Message{Command: "publish", Tags: []string{"secret"}, Data: "hi"}, t)
+	user.send(mist.Message{Command: "ping"}, t)
+	if msg := user.receive(t); msg.Command != "ping" {
+		t.Fatalf("Unexpected message - %#v", msg)
+	}
+}
+
+// TestSchedule tests that only admins can schedule messages, list them and remove
+// them
+func TestSchedule(t *testing.T) {
+	addr := testutil.FreeAddress(t)
+
+	// start an authenticator
+	if err := auth.Start("memory://"); err != nil {
+		t.Fatalf("Unexpected error - %s", err.Error())
+	}
+	defer auth.Start("")
+
+	go server.Start([]string{"tcp://" + addr}, "TOKEN")
+	<-time.After(time.Second)
+
+	admin := dial(addr, t)
+	defer admin.Close()
+	admin.send(mist.Message{Command: "auth", Data: "TOKEN"}, t)
+	admin.send(mist.Message{Command: "register", Tags: []string{"a"}, Data: "user"}, t)
+	admin.send(mist.Message{Command: "ping"}, t)
+	if msg := admin.receive(t); msg.Error != "" {
+		t.Fatalf("Unexpected error - %s", msg.Error)
+	}
+
+	user := dial(addr, t)
+	defer user.Close()
+	user.send(mist.Message{Command: "auth", Data: "user"}, t)
+
+	user.send(mist.Message{Command: "schedule", Tags: []string{"a"}, Data: "hi", Schedule: "@hourly"}, t)
+	if msg := user.receive(t); msg.Error == "" {
+		t.Fatalf("Expected 'schedule' to be denied - %#v", msg)
+	}
+
+	admin.send(mist.Message{Command: "schedule", Tags: []string{"a"}, Data: "hi", Schedule: "@hourly"}, t)
+	scheduled := admin.receive(t)
+	if scheduled.Error != "" || scheduled.Data == "" {
+		t.Fatalf("Unexpected reply - %#v", scheduled)
+	}
+
+	admin.send(mist.Message{Command: "schedules"}, t)
+	list := []mist.Schedule{}
+	if err := admin.receive(t).Decode(&list); err != nil || len(list) != 1 || list[0].ID != scheduled.Data {
+		t.Fatalf("Unexpected schedules - %#v", list)
+	}
+
+	admin.send(mist.Message{Command: "unschedule", Data: scheduled.Data}, t)
+	admin.send(mist.Message{Command: "unschedule", Data: scheduled.Data}, t)
+	if msg := admin.receive(t); msg.Error == "" {
+		t.Fatalf("Expected removing a schedule twice to fail - %#v", msg)
+	}
+}
+
+// TestLimits tests that connections are held to their limits, and that a token
+// can be allowed more
+func TestLimits(t *testing.T) {
+	addr := "127.0.0.1:1448"
+
+	if err := auth.Start("memory://"); err != nil {
+		t.Fatalf("Unexpected error - %s", err.Error())
+	}
+	defer auth.Start("")
+
+	server.DefaultLimits = server.Limits{Subscriptions: 2, Tags: 2, PublishRate: 1, PublishBurst: 2}
+	server.TokenLimits["vip"] = server.Limits{Subscriptions: -1}
+	defer func() {
+		server.DefaultLimits = server.Limits{}
+		delete(server.TokenLimits, "vip")
+	}()
+
+	go server.Start([]string{"tcp://" + addr, "http://127.0.0.1:8082"}, "TOKEN")
+	<-time.After(time.Second)
+
+	admin := dial(addr, t)
+	defer admin.Close()
+	admin.send(mist.Message{Command: "auth", Data: "TOKEN"}, t)
+	for _, token := range []string{"user", "vip"} {
+		admin.send(mist.Message{Command: "register", Tags: []string{"a", "b", "c", "d", "e"}, Data: token}, t)
+	}
+	admin.send(mist.Message{Command: "ping"}, t)
+	admin.receive(t)
+
+	user := dial(addr, t)
+	defer user.Close()
+	user.send(mist.Message{Command: "auth", Data: "user"}, t)
+
+	// subscribing to the same tags again doesn't count
+	for _, tags := range [][]string{{"a"}, {"b", "c"}, {"a"}} {
+		user.send(mist.Message{Command: "subscribe", Tags: tags}, t)
+	}
+	user.send(mist.Message{Command: "ping"}, t)
+	if msg := user.receive(t); msg.Command != "ping" {
+		t.Fatalf("Unexpected reply - %#v", msg)
+	}
+
+	user.send(mist.Message{Command: "subscribe", Tags: []string{"d"}}, t)
+	if msg := user.receive(t); msg.Error != server.ErrTooManySubscriptions.Error() {
+		t.Fatalf("Expected too many subscriptions - %#v", msg)
+	}
+	user.send(mist.Message{Command: "unsubscribe", Tags: []string{"a"}}, t)
+	user.send(mist.Message{Command: "subscribe", Tags: []string{"c", "d", "e"}}, t)
+	if msg := user.receive(t); msg.Error != server.ErrTooManyTags.Error() {
+		t.Fatalf("Expected too many tags - %#v", msg)
+	}
+
+	// a burst of 2 is allowed, then it's 1 a second
+	for i := 0; i < 2; i++ {
+		user.send(mist.Message{Command: "publish", Tags: []string{"e"}, Data: "hi"}, t)
+	}
+	user.send(mist.Message{Command: "publish", Tags: []string{"e"}, Data: "hi"}, t)
+	if msg := user.receive(t); msg.Error != server.ErrRateLimited.Error() {
+		t.Fatalf("Expected to be rate limited - %#v", msg)
+	}
+	user.send(mist.Message{Command: "request", Tags: []string{"e"}, Data: "hi", Correlation: "1"}, t)
+	if msg := user.receive(t); msg.Command != "reply" || msg.Correlation != "1" || msg.Error != server.ErrRateLimited.Error() {
+		t.Fatalf("Expected request to be rate limited - %#v", msg)
+	}
+	<-time.After(time.Second)
+	user.send(mist.Message{Command: "publish", Tags: []string{"e"}, Data: "hi"}, t)
+	user.send(mist.Message{Command: "ping"}, t)
+	if msg := user.receive(t); msg.Command != "ping" {
+		t.Fatalf("Unexpected reply - %#v", msg)
+	}
+
+	// the vip token has no subscription limit, but the same tag limit
+	vip := dial(addr, t)
+	defer vip.Close()
+	vip.send(mist.Message{Command: "auth", Data: "vip"}, t)
+	for _, tag := range []string{"a", "b", "c", "d", "e"} {
+		vip.send(mist.Message{Command: "subscribe", Tags: []string{tag}}, t)
+	}
+	vip.send(mist.Message{Command: "subscribe", Tags: []string{"a", "b", "c"}}, t)
+	if msg := vip.receive(t); msg.Error != server.ErrTooManyTags.Error() {
+		t.Fatalf("Expected too many tags - %#v", msg)
+	}
+
+	// limits are shared by everything using a token, so http requests (each their
+	// own connection) can't get around them; user has one subscription left
+	stream, err := http.Get("http://127.0.0.1:8082/subscribe?tags=d&x-auth-token=user")
+	if err != nil || stream.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to subscribe - %v", err)
+	}
+	defer stream.Body.Close()
+	denied, err := http.Get("http://127.0.0.1:8082/subscribe?tags=e&x-auth-token=user")
+	if err != nil {
+		t.Fatalf("Unexpected error - %s", err.Error())
+	}
+	defer denied.Body.Close()
+	msg := mist.Message{}
+	if denied.StatusCode == http.StatusOK || json.NewDecoder(denied.Body).Decode(&msg) != nil || msg.Error != server.ErrTooManySubscriptions.Error() {
+		t.Fatalf("Expected too many subscriptions - %#v", msg)
+	}
+
+	var limited bool
+	for i := 0; i < 3; i++ {
+		msg := httpCommand("POST", "http://127.0.0.1:8082/publish?x-auth-token=user", `{"tags":["e"], "data":"hi"}`, t)
+		limited = msg.Error == server.ErrRateLimited.Error()
+	}
+	if !limited {
+		t.Fatalf("Expected http publishing to be rate limited")
+	}
+}
+
+// TestMaxMessageSize tests that every listener rejects messages bigger than
+// its max-size, and reports its limit with who
+func TestMaxMessageSize(t *testing.T) {
+	auth.Start("")
+
+	go server.Start([]string{"tcp://127.0.0.1:1449?max-size=200", "ws://127.0.0.1:8889?max-size=200", "http://127.0.0.1:8081?max-size=200"}, "")
+	<-time.After(3 * time.Second)
+
+	small := mist.Message{Command: "publish", Tags: []string{"size"}, Data: "small"}
+	big := mist.Message{Command: "publish", Tags: []string{"size"}, Data: strings.Repeat("a", 200)}
+
+	// tcp
+	conn := dial("127.0.0.1:1449", t)
+	defer conn.Close()
+	conn.send(mist.Message{Command: "who"}, t)
+	if msg := conn.receive(t); !strings.Contains(msg.Data, "Max message size (this connection): 200") {
+		t.Fatalf("Unexpected who - %#v", msg)
+	}
+	for i := 0; i < 5; i++ {
+		conn.send(small, t)
+	}
+	conn.send(mist.Message{Command: "ping"}, t)
+	if msg := conn.receive(t); msg.Command != "ping" {
+		t.Fatalf("Unexpected reply - %#v", msg)
+	}
+	conn.send(big, t)
+	if msg := conn.receive(t); msg.Error != server.ErrTooLarge.Error() {
+		t.Fatalf("Expected message to be too large - %#v", msg)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err := conn.Decode(&mist.Message{}); err == nil {
+		t.Fatalf("Expected to be disconnected")
+	}
+
+	// websocket
+	ws, _, err := websocket.DefaultDialer.Dial("ws://127.0.0.1:8889/subscribe/websocket", nil)
+	if err != nil {
+		t.Fatalf("Failed to dial - %s", err.Error())
+	}
+	defer ws.Close()
+	if err := ws.WriteJSON(small); err != nil {
+		t.Fatalf("Failed to publish - %s", err.Error())
+	}
+	if err := ws.WriteJSON(big); err != nil {
+		t.Fatalf("Failed to publish - %s", err.Error())
+	}
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("Expected to be closed as too big - %v", err)
+	}
+
+	// http
+	body, _ := json.Marshal(small)
+	if msg := httpCommand("POST", "http://127.0.0.1:8081/publish", string(body), t); msg.Error != "" {
+		t.Fatalf("Failed to publish - %s", msg.Error)
+	}
+	body, _ = json.Marshal(big)
+	if msg := httpCommand("POST", "http://127.0.0.1:8081/publish", string(body), t); !strings.Contains(msg.Error, server.ErrTooLarge.Error()) {
+		t.Fatalf("Expected message to be too large - %#v", msg)
+	}
+}
+
+// testConn is a raw connection to a mist server, used to send commands that the
+// client doesn't provide
+type testConn struct {
+	net.Conn
+	*json.Encoder
+	*json.Decoder
+}
+
+// dial connects to a mist server
+func dial(addr string, t *testing.T) *testConn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial - %s", err.Error())
+	}
+
+	return &testConn{conn, json.NewEncoder(conn), json.NewDecoder(conn)}
+}
+
+// send sends a message to the server
+func (c *testConn) send(msg mist.Message, t *testing.T) {
+	if err := c.Encode(msg); err != nil {
+		t.Fatalf("Failed to send - %s", err.Error())
+	}
+}
+
+// receive waits for a message from the server
+func (c *testConn) receive(t *testing.T) (msg mist.Message) {
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if err := c.Decode(&msg); err != nil {
+		t.Fatalf("Failed to receive - %s", err.Error())
+	}
+	return
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+var (
+	// MaxMessageSize is the largest message (in bytes) a connection can send,
+	// for listeners that aren't given their own (?max-size=); 0 is unlimited
+	MaxMessageSize int64 = 1 << 20
+
+	// ErrTooLarge is returned when a connection sends a message bigger than its
+	// listener allows
+	ErrTooLarge = fmt.Errorf("Message too large")
+)
+
+type (
+	// limitedReader reads from a connection until limit bytes have been read,
+	// after which it fails with ErrTooLarge; a limit of 0 (or less) is unlimited
+	limitedReader struct {
+		r     io.ReadCloser
+		read  int64
+		limit int64
+	}
+)
+
+// maxMessageSize returns the largest message the listener started at host
+// accepts
+func maxMessageSize(host string) (int64, error) {
+	value := option(host, "max-size")
+	if value == "" {
+		return MaxMessageSize, nil
+	}
+
+	max, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || max < 0 {
+		return 0, fmt.Errorf("Bad max-size '%s'", value)
+	}
+
+	return max, nil
+}
+
+// limitBody limits the body of every request to a handler to max bytes
+func limitBody(max int64, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		req.Body = &limitedReader{r: req.Body, limit: max}
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// Read reads from the connection, up to the limit
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.limit <= 0 {
+		return l.r.Read(p)
+	}
+
+	if l.read >= l.limit {
+		return 0, ErrTooLarge
+	}
+
+	if left := l.limit - l.read; int64(len(p)) > left {
+		p = p[:left]
+	}
+
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+
+	return n, err
+}
+
+// Close closes the connection
+func (l *limitedReader) Close() error {
+	return l.r.Close()
+}
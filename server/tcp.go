@@ -1,10 +1,13 @@
 package server
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"sync"
 
 	"github.com/jcelliott/lumber"
 
@@ -12,15 +15,22 @@ import (
 	"github.com/nanopack/mist/core"
 )
 
-// init adds "tcp" as an available mist server type
+// init adds "tcp" and "tls" as available mist server types
 func init() {
 	Register("tcp", StartTCP)
+	Register("tls", StartTLS)
 }
 
 // StartTCP starts a tcp server listening on the specified address (default 127.0.0.1:1445)
 // and then continually reads from the server handling any incoming connections
 func StartTCP(uri string, errChan chan<- error) {
 
+	max, err := maxMessageSize(uri)
+	if err != nil {
+		errChan <- fmt.Errorf("Failed to start tcp listener - %s", err.Error())
+		return
+	}
+
 	// start a TCP listener
 	ln, err := net.Listen("tcp", uri)
 	if err != nil {
@@ -31,51 +41,115 @@ func StartTCP(uri string, errChan chan<- error) {
 	lumber.Info("TCP server listening at '%s'...", uri)
 
 	// start continually listening for any incoming tcp connections (non-blocking)
-	go func() {
-		for {
+	go accept(ln, max, errChan)
+}
 
-			// accept connections
-			conn, err := ln.Accept()
-			if err != nil {
-				errChan <- fmt.Errorf("Failed to accept TCP connection %s", err.Error())
-				return
-			}
+// StartTLS starts a tcp server listening over TLS on the specified address, and
+// then continually reads from the server handling any incoming connections. If
+// the listener has a CA (?ca= or CAFile) clients are required to present a
+// certificate signed by it.
+func StartTLS(uri string, errChan chan<- error) {
 
-			// handle each connection individually (non-blocking)
-			go handleConnection(conn, errChan)
+	config, err := tlsConfig(uri)
+	if err != nil {
+		errChan <- fmt.Errorf("Failed to start tls listener - %s", err.Error())
+		return
+	}
+
+	max, err := maxMessageSize(uri)
+	if err != nil {
+		errChan <- fmt.Errorf("Failed to start tls listener - %s", err.Error())
+		return
+	}
+
+	// start a TLS listener
+	ln, err := tls.Listen("tcp", uri, config)
+	if err != nil {
+		errChan <- fmt.Errorf("Failed to start tls listener - %s", err.Error())
+		return
+	}
+
+	lumber.Info("TLS server listening at '%s'...", uri)
+
+	// start continually listening for any incoming tls connections (non-blocking)
+	go accept(ln, max, errChan)
+}
+
+// accept continually accepts connections from a listener, handling each one
+// individually; connections can't send messages bigger than max bytes
+func accept(ln net.Listener, max int64, errChan chan<- error) {
+	for {
+
+		// accept connections
+		conn, err := ln.Accept()
+		if err != nil {
+			errChan <- fmt.Errorf("Failed to accept TCP connection %s", err.Error())
+			return
 		}
-	}()
+
+		// handle each connection individually (non-blocking)
+		go handleConnection(conn, max, errChan)
+	}
 }
 
 // handleConnection takes an incoming connection from a mist client (or other client)
 // and sets up a new subscription for that connection, and a 'publish Handler'
-// that is used to publish messages to the data channel of the subscription
-func handleConnection(conn net.Conn, errChan chan<- error) {
+// that is used to publish messages to the data channel of the subscription. A
+// message bigger than max bytes disconnects the client.
+func handleConnection(conn net.Conn, max int64, errChan chan<- error) {
 
 	// close the connection when we're done here
 	defer conn.Close()
 
 	// create a new client for each connection
 	proxy := mist.NewProxy()
+	proxy.MaxMessageSize = max
 	defer proxy.Close()
 
 	// add basic TCP command handlers for this connection
 	handlers := GenerateHandlers()
 
+	// replies to commands are written from the read loop below while messages are
+	// written from the pipe, so the encoder is only used by one of them at a time
 	encoder := json.NewEncoder(conn)
-	decoder := json.NewDecoder(conn)
+	var encoderTex sync.Mutex
+	send := func(msg *mist.Message) error {
+		encoderTex.Lock()
+		defer encoderTex.Unlock()
+		return encoder.Encode(msg)
+	}
+
+	reader := &limitedReader{r: conn}
+	decoder := json.NewDecoder(reader)
 
 	// publish mist messages (pong, etc.. and messages if subscriber attatched)
 	// to connected tcp client (non-blocking)
 	go func() {
-		for msg := range proxy.Pipe {
-			lumber.Trace("Got message - %#v", msg)
-			// if the message fails to encode its probably a syntax issue and needs to
-			// break the loop here because it will never be able to encode it; this will
-			// disconnect the client.
-			if err := encoder.Encode(msg); err != nil {
-				errChan <- fmt.Errorf("Failed to pubilsh proxy.Pipe contents to TCP clients - %s", err.Error())
-				break
+		for {
+			select {
+			case msg, ok := <-proxy.Pipe:
+				if !ok {
+					return
+				}
+
+				lumber.Trace("Got message - %#v", msg)
+				// if the message fails to encode its probably a syntax issue and needs to
+				// break the loop here because it will never be able to encode it; this will
+				// disconnect the client.
+				if err := send(&msg); err != nil {
+					errChan <- fmt.Errorf("Failed to pubilsh proxy.Pipe contents to TCP clients - %s", err.Error())
+					return
+				}
+
+			// the client fell too far behind; closing the connection ends the read loop
+			// below, but the pipe still has to be drained until the proxy is closed
+			case <-proxy.Slow():
+				lumber.Debug("TCP client too far behind, disconnecting")
+				send(&mist.Message{Command: "publish", Error: ErrSlow.Error()})
+				conn.Close()
+				for range proxy.Pipe {
+				}
+				return
 			}
 		}
 	}()
@@ -86,11 +160,21 @@ func handleConnection(conn net.Conn, errChan chan<- error) {
 	for {
 		msg := mist.Message{}
 
+		// only allow reading up to max bytes past the end of the last message; the
+		// decoder may have read past it already, which is what it has buffered
+		if max > 0 {
+			buffered, _ := io.Copy(ioutil.Discard, decoder.Buffered())
+			reader.limit = reader.read - buffered + max
+		}
+
 		// if the message fails to decode its probably a syntax issue and needs to
 		// break the loop here because it will never be able to decode it; this will
 		// disconnect the client.
 		if err := decoder.Decode(&msg); err != nil {
 			switch err {
+			case ErrTooLarge:
+				lumber.Debug("TCP client sent a message larger than %d bytes, disconnecting", max)
+				send(&mist.Message{Error: ErrTooLarge.Error()})
 			case io.EOF:
 				lumber.Debug("Client disconnected")
 			case io.ErrUnexpectedEOF:
@@ -102,24 +186,13 @@ func handleConnection(conn net.Conn, errChan chan<- error) {
 		}
 
 		// if an authenticator was passed, check for a token on connect to see if
-		// auth commands are allowed
+		// auth commands are allowed, or which tags the connection is allowed
 		if auth.IsConfigured() && !proxy.Authenticated {
-
-			// if the next input does not match the token then
-			if msg.Data != authtoken {
-				lumber.Debug("Client data doesn't match configured auth token")
+			if err := authenticate(proxy, msg.Data, handlers); err != nil {
+				lumber.Debug("Client data doesn't match an authorized token")
 				// break // allow connection w/o admin commands
 				return // disconnect client
 			}
-
-			// todo: is this still used?
-			// add auth commands ("admin" mode)
-			for k, v := range auth.GenerateHandlers() {
-				handlers[k] = v
-			}
-
-			// establish that the connection has already authenticated
-			proxy.Authenticated = true
 		}
 
 		// look for the command
@@ -128,7 +201,7 @@ func handleConnection(conn net.Conn, errChan chan<- error) {
 		// if the command isn't found, return an error and wait for the next command
 		if !found {
 			lumber.Trace("Command '%s' not found", msg.Command)
-			encoder.Encode(&mist.Message{Command: msg.Command, Tags: msg.Tags, Data: msg.Data, Error: "Unknown Command"})
+			send(&mist.Message{Command: msg.Command, Tags: msg.Tags, Data: msg.Data, Error: "Unknown Command"})
 			continue
 		}
 
@@ -137,7 +210,7 @@ func handleConnection(conn net.Conn, errChan chan<- error) {
 		lumber.Trace("TCP Running '%s'...", msg.Command)
 		if err := handler(proxy, msg); err != nil {
 			lumber.Debug("TCP Failed to run '%s' - %s", msg.Command, err.Error())
-			encoder.Encode(&mist.Message{Command: msg.Command, Error: err.Error()})
+			send(&mist.Message{Command: msg.Command, Error: err.Error()})
 			continue
 		}
 	}
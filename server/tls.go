@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/nanobox-io/golang-nanoauth"
+)
+
+// certificate returns the certificate and key files for the listener started at
+// host; a listener's own (?cert=&key=) take precedence over CertFile/KeyFile
+func certificate(host string) (cert, key string, err error) {
+	cert, key = option(host, "cert"), option(host, "key")
+	if cert == "" && key == "" {
+		cert, key = CertFile, KeyFile
+	}
+
+	if (cert == "") != (key == "") {
+		return "", "", fmt.Errorf("Both a certificate and a key are needed")
+	}
+
+	return cert, key, nil
+}
+
+// listenAndServeTLS serves handler over TLS using the configured certificate
+// for the listener, falling back to a generated (self-signed) one (blocking)
+func listenAndServeTLS(address string, handler http.Handler) error {
+	cert, key, err := certificate(address)
+	if err != nil {
+		return err
+	}
+
+	if cert == "" {
+		return nanoauth.ListenAndServeTLS(address, "", handler)
+	}
+
+	return http.ListenAndServeTLS(address, cert, key, handler)
+}
+
+// tlsConfig creates the TLS config for the listener started at host; unlike the
+// http listeners a certificate is required. If the listener has a CA (?ca= or
+// CAFile) clients need a certificate signed by it.
+func tlsConfig(host string) (*tls.Config, error) {
+	certFile, keyFile, err := certificate(host)
+	if err != nil {
+		return nil, err
+	}
+
+	if certFile == "" {
+		return nil, fmt.Errorf("Missing certificate (?cert=&key= or --tls-cert/--tls-key)")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load certificate - %s", err.Error())
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	ca := option(host, "ca")
+	if ca == "" {
+		ca = CAFile
+	}
+
+	// require client certificates (mTLS)
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA - %s", err.Error())
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA '%s'", ca)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
@@ -8,7 +8,6 @@ import (
 	"github.com/gorilla/pat"
 	"github.com/gorilla/websocket"
 	"github.com/jcelliott/lumber"
-	"github.com/nanobox-io/golang-nanoauth"
 
 	"github.com/nanopack/mist/auth"
 	"github.com/nanopack/mist/core"
@@ -22,6 +21,12 @@ func init() {
 
 // StartWS starts a mist server listening over a websocket
 func StartWS(uri string, errChan chan<- error) {
+	max, err := maxMessageSize(uri)
+	if err != nil {
+		errChan <- fmt.Errorf("Unable to start mist ws listener - %s", err.Error())
+		return
+	}
+
 	router := pat.New()
 	router.Get("/subscribe/websocket", func(rw http.ResponseWriter, req *http.Request) {
 
@@ -42,7 +47,11 @@ func StartWS(uri string, errChan chan<- error) {
 		}
 		defer conn.Close()
 
+		// messages bigger than max close the connection (as 1009, message too big)
+		conn.SetReadLimit(max)
+
 		proxy := mist.NewProxy()
+		proxy.MaxMessageSize = max
 		defer proxy.Close()
 
 		// add basic WS handlers for this socket
@@ -50,48 +59,45 @@ func StartWS(uri string, errChan chan<- error) {
 
 		// read and publish mist messages to connected clients (non-blocking)
 		go func() {
-			for msg := range proxy.Pipe {
-
-				// failing to write is probably because the connection is dead; we dont
-				// want mist just looping forever tyring to write to something it will
-				// never be able to.
-				if err := conn.WriteJSON(msg); err != nil {
-					if err.Error() != "websocket: close sent" {
-						errChan <- fmt.Errorf("Failed to WriteJSON message to WS connection - %s", err.Error())
+			for {
+				select {
+				case msg, ok := <-proxy.Pipe:
+					if !ok {
+						return
 					}
 
-					break
+					// failing to write is probably because the connection is dead; we dont
+					// want mist just looping forever tyring to write to something it will
+					// never be able to.
+					if err := conn.WriteJSON(msg); err != nil {
+						if err.Error() != "websocket: close sent" {
+							errChan <- fmt.Errorf("Failed to WriteJSON message to WS connection - %s", err.Error())
+						}
+
+						return
+					}
+
+				// the client fell too far behind; closing the connection ends the read
+				// loop, but the pipe still has to be drained until the proxy is closed
+				case <-proxy.Slow():
+					lumber.Debug("WS client too far behind, disconnecting")
+					conn.WriteJSON(&mist.Message{Command: "publish", Error: ErrSlow.Error()})
+					conn.Close()
+					for range proxy.Pipe {
+					}
+					return
 				}
 			}
 		}()
 
 		// if an authenticator was passed, check for a token on connect to see if
-		// auth commands are added
+		// auth commands are added, or which tags the socket is allowed
 		if auth.IsConfigured() && !proxy.Authenticated {
-
-			var xtoken string
-			switch {
-			case req.Header.Get("X-AUTH-TOKEN") != "":
-				xtoken = req.Header.Get("X-AUTH-TOKEN")
-			case req.FormValue("x-auth-token") != "":
-				xtoken = req.FormValue("x-auth-token")
-			}
-
-			// if the next input matches the token then add auth commands
-			if xtoken != authtoken {
+			if err := authenticate(proxy, requestToken(req), handlers); err != nil {
 				// break // allow connection w/o admin commands
-				errChan <- fmt.Errorf("Token given doesn't match configured token")
+				errChan <- err
 				return // disconnect client
 			}
-
-			// todo: still used?
-			// add auth commands ("admin" mode)
-			for k, v := range auth.GenerateHandlers() {
-				handlers[k] = v
-			}
-
-			// establish that the socket has already authenticated
-			proxy.Authenticated = true
 		}
 
 		// connection loop (blocking); continually read off the connection. Once something
@@ -105,6 +111,11 @@ func StartWS(uri string, errChan chan<- error) {
 			// want mist just looping forever tyring to write to something it will
 			// never be able to.
 			if err := conn.ReadJSON(&msg); err != nil {
+				if err == websocket.ErrReadLimit {
+					lumber.Debug("WS client sent a message larger than %d bytes, disconnecting", max)
+					break
+				}
+
 				// todo: better logging here too
 				if !strings.Contains(err.Error(), "websocket: close 1001") && 
 				!strings.Contains(err.Error(), "websocket: close 1005") && 
@@ -146,6 +157,12 @@ func StartWS(uri string, errChan chan<- error) {
 
 // StartWSS starts a mist server listening over a secure websocket
 func StartWSS(uri string, errChan chan<- error) {
+	max, err := maxMessageSize(uri)
+	if err != nil {
+		errChan <- fmt.Errorf("Unable to start mist wss listener - %s", err.Error())
+		return
+	}
+
 	router := pat.New()
 	router.Get("/subscribe/websocket", func(rw http.ResponseWriter, req *http.Request) {
 
@@ -166,7 +183,11 @@ func StartWSS(uri string, errChan chan<- error) {
 		}
 		defer conn.Close()
 
+		// messages bigger than max close the connection (as 1009, message too big)
+		conn.SetReadLimit(max)
+
 		proxy := mist.NewProxy()
+		proxy.MaxMessageSize = max
 		defer proxy.Close()
 
 		// add basic WS handlers for this socket
@@ -174,49 +195,45 @@ func StartWSS(uri string, errChan chan<- error) {
 
 		// read and publish mist messages to connected clients (non-blocking)
 		go func() {
-			for msg := range proxy.Pipe {
-
-				// failing to write is probably because the connection is dead; we dont
-				// want mist just looping forever tyring to write to something it will
-				// never be able to.
-				if err := conn.WriteJSON(msg); err != nil {
-					if err.Error() != "websocket: close sent" {
-						errChan <- fmt.Errorf("Failed to WriteJSON message to WSS connection - %s", err.Error())
+			for {
+				select {
+				case msg, ok := <-proxy.Pipe:
+					if !ok {
+						return
 					}
 
-					break
+					// failing to write is probably because the connection is dead; we dont
+					// want mist just looping forever tyring to write to something it will
+					// never be able to.
+					if err := conn.WriteJSON(msg); err != nil {
+						if err.Error() != "websocket: close sent" {
+							errChan <- fmt.Errorf("Failed to WriteJSON message to WSS connection - %s", err.Error())
+						}
+
+						return
+					}
+
+				// the client fell too far behind; closing the connection ends the read
+				// loop, but the pipe still has to be drained until the proxy is closed
+				case <-proxy.Slow():
+					lumber.Debug("WSS client too far behind, disconnecting")
+					conn.WriteJSON(&mist.Message{Command: "publish", Error: ErrSlow.Error()})
+					conn.Close()
+					for range proxy.Pipe {
+					}
+					return
 				}
 			}
 		}()
 
 		// if an authenticator was passed, check for a token on connect to see if
-		// auth commands are added
+		// auth commands are added, or which tags the socket is allowed
 		if auth.IsConfigured() && !proxy.Authenticated {
-			var xtoken string
-			switch {
-			case req.Header.Get("X-AUTH-TOKEN") != "":
-				xtoken = req.Header.Get("X-AUTH-TOKEN")
-			case req.FormValue("x-auth-token") != "":
-				xtoken = req.FormValue("x-auth-token")
-			case req.FormValue("X-AUTH-TOKEN") != "":
-				xtoken = req.FormValue("X-AUTH-TOKEN")
-			}
-
-			// if the next input matches the token then add auth commands
-			if xtoken != authtoken {
+			if err := authenticate(proxy, requestToken(req), handlers); err != nil {
 				// break // allow connection w/o admin commands
-				errChan <- fmt.Errorf("Token given doesn't match configured token - %s", xtoken)
+				errChan <- err
 				return // disconnect client
 			}
-
-			// todo: still used?
-			// add auth commands ("admin" mode)
-			for k, v := range auth.GenerateHandlers() {
-				handlers[k] = v
-			}
-
-			// establish that the socket has already authenticated
-			proxy.Authenticated = true
 		}
 
 		// connection loop (blocking); continually read off the connection. Once something
@@ -230,6 +247,11 @@ func StartWSS(uri string, errChan chan<- error) {
 			// want mist just looping forever tyring to write to something it will
 			// never be able to.
 			if err := conn.ReadJSON(&msg); err != nil {
+				if err == websocket.ErrReadLimit {
+					lumber.Debug("WSS client sent a message larger than %d bytes, disconnecting", max)
+					break
+				}
+
 				if !strings.Contains(err.Error(), "websocket: close 1001") && 
 				!strings.Contains(err.Error(), "websocket: close 1005") && 
 				!strings.Contains(err.Error(), "websocket: close 1006") { // don't log if client disconnects
@@ -264,5 +286,20 @@ func StartWSS(uri string, errChan chan<- error) {
 	})
 
 	lumber.Info("WSS server listening at '%s'...\n", uri)
-	nanoauth.ListenAndServeTLS(uri, "", router)
+	if err := listenAndServeTLS(uri, router); err != nil {
+		errChan <- fmt.Errorf("Unable to start mist wss listener - %s", err.Error())
+	}
+}
+
+// requestToken finds the auth token provided with a request, either as a header
+// or as a query param
+func requestToken(req *http.Request) string {
+	switch {
+	case req.Header.Get("X-AUTH-TOKEN") != "":
+		return req.Header.Get("X-AUTH-TOKEN")
+	case req.FormValue("x-auth-token") != "":
+		return req.FormValue("x-auth-token")
+	default:
+		return req.FormValue("X-AUTH-TOKEN")
+	}
 }
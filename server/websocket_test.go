@@ -1,11 +1,16 @@
 package server_test
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
+
 	"github.com/nanopack/mist/auth"
+	"github.com/nanopack/mist/core"
 	"github.com/nanopack/mist/server"
 )
 
@@ -38,3 +43,48 @@ func TestWSSStart(t *testing.T) {
 	}()
 	<-time.After(time.Second)
 }
+
+// TestWSBinary tests to ensure arbitrary bytes, including newlines and NULs,
+// make it through a websocket (and the http api) untouched
+func TestWSBinary(t *testing.T) {
+	url := "ws://127.0.0.1:8888/subscribe/websocket"
+
+	subscriber, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Failed to dial - %s", err.Error())
+	}
+	defer subscriber.Close()
+
+	publisher, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Failed to dial - %s", err.Error())
+	}
+	defer publisher.Close()
+
+	if err := subscriber.WriteJSON(mist.Message{Command: "subscribe", Tags: []string{"blob"}}); err != nil {
+		t.Fatalf("Failed to subscribe - %s", err.Error())
+	}
+	<-time.After(100 * time.Millisecond)
+
+	blob := []byte("line one\nline two\x00\xff\r\n")
+
+	// publish once over the websocket, and once over the http api
+	if err := publisher.WriteJSON(mist.Message{Command: "publish", Tags: []string{"blob"}, Binary: blob}); err != nil {
+		t.Fatalf("Failed to publish - %s", err.Error())
+	}
+	body, _ := json.Marshal(mist.Message{Tags: []string{"blob"}, Binary: blob})
+	if msg := httpCommand("POST", "http://127.0.0.1:8080/publish", string(body), t); msg.Error != "" {
+		t.Fatalf("Failed to publish - %s", msg.Error)
+	}
+
+	subscriber.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 2; i++ {
+		msg := mist.Message{}
+		if err := subscriber.ReadJSON(&msg); err != nil {
+			t.Fatalf("Failed to read message - %s", err.Error())
+		}
+		if !bytes.Equal(msg.Binary, blob) {
+			t.Fatalf("Unexpected binary - %q", msg.Binary)
+		}
+	}
+}